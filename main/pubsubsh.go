@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	_ "github.com/qorio/maestro/pkg/mqtt"
@@ -25,6 +26,15 @@ func must_not(err error) {
 	}
 }
 
+// Tasks publish their output as StreamMessages.  Anything else is printed as is.
+func stream_data(m []byte) string {
+	sm := StreamMessage{}
+	if err := json.Unmarshal(m, &sm); err != nil || len(sm.Stream) == 0 {
+		return string(m)
+	}
+	return sm.Data
+}
+
 func main() {
 
 	flag.Usage = func() {
@@ -57,10 +67,10 @@ func main() {
 		for {
 			select {
 			case m := <-stdout:
-				fmt.Print(string(m))
+				fmt.Print(stream_data(m))
 				fmt.Print("dash% ")
 			case m := <-stderr:
-				fmt.Print(string(m))
+				fmt.Print(stream_data(m))
 				fmt.Print("dash% ")
 			case <-stdin:
 			}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	_ "github.com/qorio/maestro/pkg/mqtt"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/task"
+	_ "github.com/qorio/maestro/pkg/task/docker"
+	_ "github.com/qorio/maestro/pkg/task/ssh"
+	"github.com/qorio/maestro/pkg/zk"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Value set by ldflag (-X main.BUILD_VERSION version) during build
+var (
+	BUILD_VERSION   string
+	BUILD_TIMESTAMP string
+)
+var (
+	queue       = flag.String("queue", "", "Registry path of the task queue")
+	concurrency = flag.Int("concurrency", task.DefaultWorkerConcurrency, "Max number of tasks to run at once")
+	poll        = flag.Duration("poll", task.DefaultWorkerPollInterval, "Interval to rescan the queue")
+	timeout     = flag.Duration("zk_timeout", 5*time.Second, "ZK session timeout")
+	secret_key  = flag.String("secret_key", "", "File with the base64 encoded AES key for secret:// env values")
+)
+
+func must_not(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s version %s, built on %s\n", os.Args[0], BUILD_VERSION, BUILD_TIMESTAMP)
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(*queue) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	zkc, err := zk.Connect(zk.ZkHosts(), *timeout)
+	must_not(err)
+
+	worker := task.NewWorker(zkc, registry.Path(*queue), *concurrency)
+	worker.PollInterval = *poll
+
+	if len(*secret_key) > 0 {
+		encoded, err := ioutil.ReadFile(*secret_key)
+		must_not(err)
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		must_not(err)
+		worker.Decrypter, err = task.AESDecrypter(key)
+		must_not(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		glog.Infoln("Received", s, "Stopping worker.")
+		worker.Stop()
+	}()
+
+	must_not(worker.Run())
+	zkc.Close()
+}
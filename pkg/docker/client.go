@@ -9,6 +9,7 @@ import (
 	"net"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -262,6 +263,30 @@ func (c *Docker) RemoveImage(image string, force, prune bool) error {
 	})
 }
 
+// Streams the stdout and stderr of the container until the container exits.
+func (c *Docker) FollowLogs(auth *AuthIdentity, id string, stdout, stderr io.Writer) error {
+	return c.docker.Logs(_docker.LogsOptions{
+		Container:    id,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Follow:       true,
+		Stdout:       true,
+		Stderr:       true,
+	})
+}
+
+// Blocks until the container stops and returns its exit code.
+func (c *Docker) WaitContainer(auth *AuthIdentity, id string) (int, error) {
+	return c.docker.WaitContainer(id)
+}
+
+func (c *Docker) KillContainer(auth *AuthIdentity, id string, sig syscall.Signal) error {
+	return c.docker.KillContainer(_docker.KillContainerOptions{
+		ID:     id,
+		Signal: _docker.Signal(sig),
+	})
+}
+
 type Action int
 
 const (
@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStreamMaxChunk   = 4096
+	DefaultStreamBatchSize  = 16384
+	DefaultStreamBatchDelay = 100 * time.Millisecond
+)
+
+// Published by the stream writer as JSON.  Data holds whole lines, except when a line is
+// longer than the max chunk or when the writer is flushed with a partial line pending.
+// Concatenating Data in Seq order reassembles the stream;  a gap in Seq means a lost message.
+type StreamMessage struct {
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Data      string `json:"data"`
+}
+
+// Frames the output by line and publishes batches of lines when either the batch size is
+// reached or the batch delay passes after the first pending write.
+type StreamWriter struct {
+	Stream     string
+	MaxChunk   int
+	BatchSize  int
+	BatchDelay time.Duration
+
+	// Optional transformation of the data before publishing, e.g. masking.
+	Filter func([]byte) []byte
+
+	pub   Publisher
+	topic Topic
+
+	line  bytes.Buffer // partial line
+	batch bytes.Buffer // complete lines
+	seq   uint64
+	timer *time.Timer
+	lock  sync.Mutex
+}
+
+func NewStreamWriter(topic Topic, pub Publisher, stream string) *StreamWriter {
+	return &StreamWriter{
+		Stream:     stream,
+		MaxChunk:   DefaultStreamMaxChunk,
+		BatchSize:  DefaultStreamBatchSize,
+		BatchDelay: DefaultStreamBatchDelay,
+		pub:        pub,
+		topic:      topic,
+	}
+}
+
+func (this *StreamWriter) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.MaxChunk <= 0 {
+		this.MaxChunk = DefaultStreamMaxChunk
+	}
+	for rest := p; len(rest) > 0; {
+		complete := false
+		if i := bytes.IndexByte(rest, '\n'); i < 0 {
+			this.line.Write(rest)
+			rest = nil
+		} else {
+			this.line.Write(rest[:i+1])
+			rest = rest[i+1:]
+			complete = true
+		}
+		if err := this.take(complete); err != nil {
+			return 0, err
+		}
+	}
+
+	if this.batch.Len() >= this.BatchSize {
+		if err := this.publish(); err != nil {
+			return 0, err
+		}
+	}
+	if (this.batch.Len() > 0 || this.line.Len() > 0) && this.timer == nil {
+		this.timer = time.AfterFunc(this.BatchDelay, func() { this.Flush() })
+	}
+	return len(p), nil
+}
+
+// Moves the line to the batch if it's complete, or max chunk sized pieces of it if it's too long.
+func (this *StreamWriter) take(complete bool) error {
+	for {
+		n := this.line.Len()
+		switch {
+		case n >= this.MaxChunk:
+			n = this.MaxChunk
+		case n > 0 && complete:
+		default:
+			return nil
+		}
+		if this.batch.Len()+n > this.BatchSize {
+			if err := this.publish(); err != nil {
+				return err
+			}
+		}
+		this.batch.Write(this.line.Next(n))
+	}
+}
+
+// Publishes the pending lines, including any partial line.
+func (this *StreamWriter) Flush() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.batch.Write(this.line.Next(this.line.Len()))
+	return this.publish()
+}
+
+func (this *StreamWriter) Close() error {
+	return this.Flush()
+}
+
+// Must be called with the lock held.
+func (this *StreamWriter) publish() error {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+	if this.batch.Len() == 0 {
+		return nil
+	}
+	data := this.batch.Bytes()
+	if this.Filter != nil {
+		data = this.Filter(data)
+	}
+	this.seq++
+	m, err := json.Marshal(StreamMessage{
+		Stream:    this.Stream,
+		Seq:       this.seq,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Data:      string(data),
+	})
+	this.batch.Reset()
+	if err != nil {
+		return err
+	}
+	return this.pub.Publish(this.topic, m)
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) { TestingT(t) }
+
+type StreamTests struct{}
+
+var _ = Suite(&StreamTests{})
+
+type recorder struct {
+	messages []StreamMessage
+	lock     sync.Mutex
+}
+
+func (this *recorder) Publish(topic Topic, message []byte) error {
+	m := StreamMessage{}
+	if err := json.Unmarshal(message, &m); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = append(this.messages, m)
+	return nil
+}
+
+func (this *recorder) data() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	d := []string{}
+	for _, m := range this.messages {
+		d = append(d, m.Data)
+	}
+	return d
+}
+
+func (suite *StreamTests) TestFramesByLine(c *C) {
+	r := &recorder{}
+	w := NewStreamWriter(Topic("mqtt://localhost:1883/test"), r, "stdout")
+	w.BatchSize = 12
+
+	w.Write([]byte("hel"))
+	w.Write([]byte("lo\nwor"))
+	w.Write([]byte("ld\nfoo\n"))
+	c.Assert(r.data(), DeepEquals, []string{"hello\nworld\n"})
+
+	w.Flush()
+	c.Assert(r.data(), DeepEquals, []string{"hello\nworld\n", "foo\n"})
+	for i, m := range r.messages {
+		c.Assert(m.Seq, Equals, uint64(i+1))
+		c.Assert(m.Stream, Equals, "stdout")
+	}
+}
+
+func (suite *StreamTests) TestMaxChunk(c *C) {
+	r := &recorder{}
+	w := NewStreamWriter(Topic("mqtt://localhost:1883/test"), r, "stderr")
+	w.MaxChunk = 4
+	w.BatchSize = 4
+
+	w.Write([]byte("abcdefghij\nxy"))
+	w.Close()
+	c.Assert(r.data(), DeepEquals, []string{"abcd", "efgh", "ij\nxy"})
+	c.Assert(strings.Join(r.data(), ""), Equals, "abcdefghij\nxy")
+}
+
+func (suite *StreamTests) TestBatchDelay(c *C) {
+	r := &recorder{}
+	w := NewStreamWriter(Topic("mqtt://localhost:1883/test"), r, "stdout")
+	w.BatchDelay = 20 * time.Millisecond
+	w.Filter = func(b []byte) []byte { return []byte(strings.ToUpper(string(b))) }
+
+	w.Write([]byte("one\n"))
+	w.Write([]byte("prompt> "))
+	c.Assert(len(r.data()), Equals, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(r.data(), DeepEquals, []string{"ONE\nPROMPT> "})
+}
@@ -0,0 +1,677 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrBadCondition = errors.New("bad-condition")
+)
+
+// A node in a boolean tree of conditions.  Either one of And, Or and Not is set, or exactly
+// one of the leaf conditions.  In JSON, a string is parsed as an expression.  See ParseCondition.
+type Condition struct {
+	And []Condition `json:"and,omitempty"`
+	Or  []Condition `json:"or,omitempty"`
+	Not *Condition  `json:"not,omitempty"`
+
+	Create  *Create  `json:"create,omitempty"`
+	Delete  *Delete  `json:"delete,omitempty"`
+	Change  *Change  `json:"change,omitempty"`
+	Members *Members `json:"members,omitempty"`
+
+	// Predicate on the new value of a change
+	Value *Predicate `json:"value,omitempty"`
+
+	// The condition must hold for this long before it is true, and starts over if it goes
+	// false.  A leaf with a stable_for is watched for its state as in level mode.
+	StableFor *Timeout `json:"stable_for,omitempty"`
+}
+
+func (this *Condition) UnmarshalJSON(s []byte) error {
+	if len(s) > 0 && s[0] == '"' {
+		var expr string
+		if err := json.Unmarshal(s, &expr); err != nil {
+			return err
+		}
+		c, err := ParseCondition(expr)
+		if err != nil {
+			return err
+		}
+		*this = *c
+		return nil
+	}
+	// Alias without the methods so this is not called again
+	type condition Condition
+	return json.Unmarshal(s, (*condition)(this))
+}
+
+func (this *Condition) IsLeaf() bool {
+	return this.Create != nil || this.Delete != nil || this.Change != nil || this.Members != nil
+}
+
+func (this *Condition) Validate() error {
+	count := 0
+	for _, set := range []bool{len(this.And) > 0, len(this.Or) > 0, this.Not != nil,
+		this.Create != nil, this.Delete != nil, this.Change != nil, this.Members != nil} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 {
+		return ErrBadCondition
+	}
+	switch {
+	case this.StableFor != nil && *this.StableFor <= 0:
+		return ErrBadCondition
+	case this.StableFor != nil && this.IsLeaf() && !this.has_state():
+		return ErrBadCondition
+	case this.Not != nil && this.Not.StableFor != nil:
+		// The negation would hold at once and through the window.  See unary.
+		return ErrBadCondition
+	case this.Create != nil && !this.Create.Valid():
+		return ErrBadCondition
+	case this.Delete != nil && !this.Delete.Valid():
+		return ErrBadCondition
+	case this.Change != nil && !this.Change.Valid():
+		return ErrBadCondition
+	case this.Members != nil && !this.Members.Top.Valid():
+		return ErrBadCondition
+	case this.Value != nil && this.Change == nil:
+		return ErrBadCondition
+	case this.Value != nil:
+		return this.Value.Validate()
+	case this.Not != nil:
+		return this.Not.Validate()
+	}
+	for _, terms := range [][]Condition{this.And, this.Or} {
+		for _, c := range terms {
+			if err := c.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// True if the leaf is about the state of a node rather than an event, so it can hold for
+// some time.  A change without a value predicate or with the changed op and a delta of
+// members are only events.
+func (this *Condition) has_state() bool {
+	switch {
+	case this.Change != nil:
+		return this.Value != nil && this.Value.Op != OpChanged
+	case this.Members != nil:
+		return this.Members.Delta == nil
+	}
+	return this.IsLeaf()
+}
+
+// Returns the leaves in order from left to right.
+func (this *Condition) Leaves() []*Condition {
+	switch {
+	case this.IsLeaf():
+		return []*Condition{this}
+	case this.Not != nil:
+		return this.Not.Leaves()
+	}
+	leaves := []*Condition{}
+	for i := range this.And {
+		leaves = append(leaves, this.And[i].Leaves()...)
+	}
+	for i := range this.Or {
+		leaves = append(leaves, this.Or[i].Leaves()...)
+	}
+	return leaves
+}
+
+// Returns the leaves under a not.
+func (this *Condition) Negated() []*Condition {
+	if this.Not != nil {
+		return this.Not.Leaves()
+	}
+	leaves := []*Condition{}
+	for i := range this.And {
+		leaves = append(leaves, this.And[i].Negated()...)
+	}
+	for i := range this.Or {
+		leaves = append(leaves, this.Or[i].Negated()...)
+	}
+	return leaves
+}
+
+// Returns the leaves under a node with a stable_for.
+func (this *Condition) Stable() []*Condition {
+	switch {
+	case this.StableFor != nil:
+		return this.Leaves()
+	case this.Not != nil:
+		return this.Not.Stable()
+	}
+	leaves := []*Condition{}
+	for i := range this.And {
+		leaves = append(leaves, this.And[i].Stable()...)
+	}
+	for i := range this.Or {
+		leaves = append(leaves, this.Or[i].Stable()...)
+	}
+	return leaves
+}
+
+// Evaluates the tree with the given values of the leaves.  If hold is given, the value of
+// each node with a stable_for is passed to it and the result is used instead.  All the
+// nodes are then evaluated so hold sees each of them.
+func (this *Condition) Eval(leaf func(*Condition) bool, hold ...func(*Condition, bool) bool) bool {
+	v := this.eval(leaf, hold...)
+	if this.StableFor != nil && len(hold) > 0 {
+		return hold[0](this, v)
+	}
+	return v
+}
+
+func (this *Condition) eval(leaf func(*Condition) bool, hold ...func(*Condition, bool) bool) bool {
+	switch {
+	case this.IsLeaf():
+		return leaf(this)
+	case this.Not != nil:
+		return !this.Not.Eval(leaf, hold...)
+	}
+	all := len(hold) > 0
+	and := len(this.And) > 0
+	terms := this.And
+	if !and {
+		terms = this.Or
+	}
+	result := and
+	for i := range terms {
+		if terms[i].Eval(leaf, hold...) != and {
+			result = !and
+			if !all {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Returns the expression form of the condition.
+func (this *Condition) String() string {
+	if this.StableFor == nil {
+		return this.expr()
+	}
+	stable := time.Duration(*this.StableFor).String()
+	if this.IsLeaf() || this.Not != nil {
+		return this.expr() + " for " + stable
+	}
+	return "(" + this.expr() + ") for " + stable
+}
+
+func (this *Condition) expr() string {
+	switch {
+	case this.Create != nil:
+		return fmt.Sprintf("create(%s)", this.Create.Path())
+	case this.Delete != nil:
+		return fmt.Sprintf("delete(%s)", this.Delete.Path())
+	case this.Change != nil && this.Value != nil && this.Value.Field != "":
+		return fmt.Sprintf("change(%s)%s", this.Change.Path(), this.Value)
+	case this.Change != nil && this.Value != nil:
+		return fmt.Sprintf("change(%s) %s", this.Change.Path(), this.Value)
+	case this.Change != nil:
+		return fmt.Sprintf("change(%s)", this.Change.Path())
+	case this.Members != nil:
+		return members_string(*this.Members)
+	case this.Not != nil && this.Not.StableFor != nil:
+		return "!(" + this.Not.String() + ")"
+	case this.Not != nil:
+		return "!" + this.Not.operand()
+	}
+	op, terms := " && ", this.And
+	if len(this.Or) > 0 {
+		op, terms = " || ", this.Or
+	}
+	parts := []string{}
+	for i := range terms {
+		parts = append(parts, terms[i].operand())
+	}
+	return strings.Join(parts, op)
+}
+
+func (this *Condition) operand() string {
+	if len(this.And)+len(this.Or) > 1 && this.StableFor == nil {
+		return "(" + this.String() + ")"
+	}
+	return this.String()
+}
+
+func members_string(m Members) string {
+	s := fmt.Sprintf("members(%s)", m.Top.Path())
+	switch {
+	case m.Min != nil && m.Max != nil && m.OutsideRange:
+		return fmt.Sprintf("%s not in [%d, %d)", s, *m.Min, *m.Max)
+	case m.Min != nil && m.Max != nil:
+		return fmt.Sprintf("%s in [%d, %d)", s, *m.Min, *m.Max)
+	case m.Min != nil:
+		return fmt.Sprintf("%s >= %d", s, *m.Min)
+	case m.Max != nil:
+		return fmt.Sprintf("%s < %d", s, *m.Max)
+	case m.Equals != nil:
+		return fmt.Sprintf("%s == %d", s, *m.Equals)
+	case m.Delta != nil:
+		return fmt.Sprintf("%s += %d", s, *m.Delta)
+	}
+	return s
+}
+
+func (this *Conditions) Validate() error {
+	for _, t := range []*Timeout{this.StableFor, this.Debounce} {
+		if t != nil && *t <= 0 {
+			return ErrBadCondition
+		}
+	}
+	if this.Value != nil {
+		if this.Change == nil {
+			return ErrBadCondition
+		}
+		if err := this.Value.Validate(); err != nil {
+			return err
+		}
+	}
+	if this.Expr != nil {
+		if err := this.Expr.Validate(); err != nil {
+			return err
+		}
+	}
+	// The stable_for of the conditions applies to the tree, which may be a single leaf
+	if tree := this.Tree(); tree != nil && this.StableFor != nil && tree.IsLeaf() && !tree.has_state() {
+		return ErrBadCondition
+	}
+	return nil
+}
+
+// Returns the tree of all the conditions.  The flat conditions are combined by All and the
+// result is and'ed with the expression, if any.  The stable_for applies to the whole tree.
+// Returns nil if there are no conditions.
+func (this *Conditions) Tree() *Condition {
+	flat := []Condition{}
+	if this.Create != nil {
+		flat = append(flat, Condition{Create: this.Create})
+	}
+	if this.Delete != nil {
+		flat = append(flat, Condition{Delete: this.Delete})
+	}
+	if this.Change != nil {
+		flat = append(flat, Condition{Change: this.Change, Value: this.Value})
+	}
+	if this.Members != nil {
+		flat = append(flat, Condition{Members: this.Members})
+	}
+
+	var tree *Condition
+	switch {
+	case len(flat) == 1:
+		tree = &flat[0]
+	case len(flat) > 1 && this.All:
+		tree = &Condition{And: flat}
+	case len(flat) > 1:
+		tree = &Condition{Or: flat}
+	}
+	switch {
+	case this.Expr == nil:
+	case tree == nil:
+		tree = this.Expr
+	default:
+		tree = &Condition{And: []Condition{*tree, *this.Expr}}
+	}
+	if tree == nil || this.StableFor == nil {
+		return tree
+	}
+	return stable(*tree, *this.StableFor)
+}
+
+// Returns the condition with the stable_for.  A condition that has one already is wrapped.
+func stable(c Condition, d Timeout) *Condition {
+	if c.StableFor != nil {
+		return &Condition{And: []Condition{c}, StableFor: &d}
+	}
+	c.StableFor = &d
+	return &c
+}
+
+// Parses an expression of conditions, e.g.
+//
+//	members(/db) >= 1 && (change(/config) || create(/flag)) && !create(/maintenance)
+//
+// Leaves are create(path), delete(path), change(path) and members(path).  Change may be
+// followed by a predicate on the value or a field of it, e.g. change(/app).status == "ready",
+// change(/count) > 3, change(/tag) ~ "^v2" or change(/app).version changed.  Members is
+// followed by one of >= n, < n, == n, in [min, max), not in [min, max) or += delta.  A leaf,
+// a negation or a parenthesized expression may be followed by for and a duration, e.g.
+// members(/db) >= 10 for 30s, for the time it must hold.  The for of a negation applies to
+// the negation, e.g. !create(/a) for 1s.  The operators are ! (or not),
+// && (or and) and || (or or), from highest to lowest precedence.  A negated leaf is watched
+// for its state as in level mode, so !create(/maintenance) holds while /maintenance does not
+// exist.  A negated leaf with no state, like a plain change(path), holds until the event.
+func ParseCondition(expr string) (*Condition, error) {
+	p := &parser{input: expr}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.input) {
+		return nil, p.error("unexpected input")
+	}
+	return c, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (this *parser) error(msg string) error {
+	return fmt.Errorf("%s: %s at %d in %q", ErrBadCondition, msg, this.pos, this.input)
+}
+
+func (this *parser) skip() {
+	for this.pos < len(this.input) && unicode.IsSpace(rune(this.input[this.pos])) {
+		this.pos++
+	}
+}
+
+// Consumes the token if next.  Word tokens must not be followed by a letter.
+func (this *parser) accept(tokens ...string) bool {
+	this.skip()
+	for _, t := range tokens {
+		if !strings.HasPrefix(this.input[this.pos:], t) {
+			continue
+		}
+		end := this.pos + len(t)
+		if unicode.IsLetter(rune(t[0])) && end < len(this.input) && unicode.IsLetter(rune(this.input[end])) {
+			continue
+		}
+		this.pos = end
+		return true
+	}
+	return false
+}
+
+func (this *parser) or() (*Condition, error) {
+	c, err := this.and()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Condition{*c}
+	for this.accept("||", "or") {
+		c, err := this.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, *c)
+	}
+	if len(terms) == 1 {
+		return &terms[0], nil
+	}
+	return &Condition{Or: terms}, nil
+}
+
+func (this *parser) and() (*Condition, error) {
+	c, err := this.unary()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Condition{*c}
+	for this.accept("&&", "and") {
+		c, err := this.unary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, *c)
+	}
+	if len(terms) == 1 {
+		return &terms[0], nil
+	}
+	return &Condition{And: terms}, nil
+}
+
+// The for binds outside the negation:  !create(/a) for 1s holds once /a has not existed for 1s.
+func (this *parser) unary() (*Condition, error) {
+	c, err := this.negation()
+	if err != nil {
+		return nil, err
+	}
+	return this.stable_for(c)
+}
+
+func (this *parser) negation() (*Condition, error) {
+	switch {
+	case this.accept("!", "not"):
+		c, err := this.negation()
+		if err != nil {
+			return nil, err
+		}
+		return &Condition{Not: c}, nil
+	case this.accept("("):
+		c, err := this.or()
+		if err != nil {
+			return nil, err
+		}
+		if !this.accept(")") {
+			return nil, this.error("expected )")
+		}
+		return c, nil
+	}
+	return this.leaf()
+}
+
+// Parses the optional for and duration after a leaf or parenthesized expression.
+func (this *parser) stable_for(c *Condition) (*Condition, error) {
+	if !this.accept("for") {
+		return c, nil
+	}
+	this.skip()
+	start := this.pos
+	for this.pos < len(this.input) && !strings.ContainsRune(" \t\n()&|", rune(this.input[this.pos])) {
+		this.pos++
+	}
+	d, err := time.ParseDuration(this.input[start:this.pos])
+	if err != nil || d <= 0 {
+		this.pos = start
+		return nil, this.error("expected duration")
+	}
+	return stable(*c, Timeout(d)), nil
+}
+
+func (this *parser) leaf() (*Condition, error) {
+	var kind string
+	for _, k := range []string{"create", "delete", "change", "members"} {
+		if this.accept(k) {
+			kind = k
+			break
+		}
+	}
+	if kind == "" {
+		return nil, this.error("expected condition")
+	}
+	if !this.accept("(") {
+		return nil, this.error("expected (")
+	}
+	path, err := this.path()
+	if err != nil {
+		return nil, err
+	}
+	if !this.accept(")") {
+		return nil, this.error("expected )")
+	}
+	switch kind {
+	case "create":
+		c := Create(path)
+		return &Condition{Create: &c}, nil
+	case "delete":
+		d := Delete(path)
+		return &Condition{Delete: &d}, nil
+	case "change":
+		c := Change(path)
+		value, err := this.predicate()
+		if err != nil {
+			return nil, err
+		}
+		return &Condition{Change: &c, Value: value}, nil
+	}
+	m, err := this.members(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Condition{Members: m}, nil
+}
+
+func (this *parser) path() (Path, error) {
+	this.skip()
+	start := this.pos
+	for this.pos < len(this.input) && this.input[this.pos] != ')' && !unicode.IsSpace(rune(this.input[this.pos])) {
+		this.pos++
+	}
+	if this.pos == start {
+		return "", this.error("expected path")
+	}
+	return Path(this.input[start:this.pos]), nil
+}
+
+// Parses the optional predicate after a change.
+func (this *parser) predicate() (*Predicate, error) {
+	p := &Predicate{}
+	if this.pos < len(this.input) && this.input[this.pos] == '.' {
+		start := this.pos
+		for this.pos < len(this.input) && !strings.ContainsRune(" \t\n=!~<>)", rune(this.input[this.pos])) {
+			this.pos++
+		}
+		p.Field = this.input[start:this.pos]
+	}
+	if this.accept(string(OpChanged)) {
+		p.Op = OpChanged
+		return p, nil
+	}
+	for _, op := range ops {
+		if this.accept(string(op)) {
+			p.Op = op
+			break
+		}
+	}
+	switch {
+	case p.Op == "" && p.Field != "":
+		return nil, this.error("expected comparison")
+	case p.Op == "":
+		return nil, nil
+	}
+	value, err := this.literal()
+	if err != nil {
+		return nil, err
+	}
+	p.Value = value
+	if err := p.Validate(); err != nil {
+		return nil, this.error("bad predicate")
+	}
+	return p, nil
+}
+
+// Parses a quoted string or a bare word or number.
+func (this *parser) literal() (string, error) {
+	this.skip()
+	start := this.pos
+	if this.pos < len(this.input) && this.input[this.pos] == '"' {
+		for this.pos++; this.pos < len(this.input) && this.input[this.pos] != '"'; this.pos++ {
+			if this.input[this.pos] == '\\' {
+				this.pos++
+			}
+		}
+		if this.pos >= len(this.input) {
+			return "", this.error("unterminated string")
+		}
+		this.pos++
+		s, err := strconv.Unquote(this.input[start:this.pos])
+		if err != nil {
+			this.pos = start
+			return "", this.error("bad string")
+		}
+		return s, nil
+	}
+	for this.pos < len(this.input) && !strings.ContainsRune(" \t\n()&|", rune(this.input[this.pos])) {
+		this.pos++
+	}
+	if this.pos == start {
+		return "", this.error("expected value")
+	}
+	return this.input[start:this.pos], nil
+}
+
+func (this *parser) members(path Path) (*Members, error) {
+	m := &Members{Top: path}
+	var err error
+	switch {
+	case this.accept(">="):
+		m.Min, err = this.int()
+	case this.accept("<"):
+		m.Max, err = this.int()
+	case this.accept("=="):
+		m.Equals, err = this.int()
+	case this.accept("+="):
+		m.Delta, err = this.int()
+	case this.accept("in"):
+		err = this.range_(m)
+	case this.accept("not"):
+		if !this.accept("in") {
+			return nil, this.error("expected in")
+		}
+		m.OutsideRange = true
+		err = this.range_(m)
+	default:
+		return nil, this.error("expected members comparison")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Parses [min, max)
+func (this *parser) range_(m *Members) (err error) {
+	if !this.accept("[") {
+		return this.error("expected [")
+	}
+	if m.Min, err = this.int(); err != nil {
+		return err
+	}
+	if !this.accept(",") {
+		return this.error("expected ,")
+	}
+	if m.Max, err = this.int(); err != nil {
+		return err
+	}
+	if !this.accept(")") {
+		return this.error("expected )")
+	}
+	return nil
+}
+
+func (this *parser) int() (*int32, error) {
+	this.skip()
+	start := this.pos
+	if this.pos < len(this.input) && (this.input[this.pos] == '-' || this.input[this.pos] == '+') {
+		this.pos++
+	}
+	for this.pos < len(this.input) && unicode.IsDigit(rune(this.input[this.pos])) {
+		this.pos++
+	}
+	n, err := strconv.ParseInt(this.input[start:this.pos], 10, 32)
+	if err != nil {
+		this.pos = start
+		return nil, this.error("expected number")
+	}
+	v := int32(n)
+	return &v, nil
+}
@@ -0,0 +1,241 @@
+package registry
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestCondition(t *testing.T) { TestingT(t) }
+
+type ConditionTests struct{}
+
+var _ = Suite(&ConditionTests{})
+
+func (suite *ConditionTests) TestParse(c *C) {
+	expr := "members(/db) >= 1 && (change(/config) || create(/flag)) && !create(/maintenance)"
+	cond, err := ParseCondition(expr)
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.Validate(), Equals, nil)
+	c.Assert(len(cond.And), Equals, 3)
+	c.Assert(*cond.And[0].Members.Min, Equals, int32(1))
+	c.Assert(len(cond.And[1].Or), Equals, 2)
+	c.Assert(*cond.And[1].Or[0].Change, Equals, Change("/config"))
+	c.Assert(*cond.And[2].Not.Create, Equals, Create("/maintenance"))
+	c.Assert(cond.String(), Equals, expr)
+
+	leaves := cond.Leaves()
+	c.Assert(len(leaves), Equals, 4)
+	c.Assert(leaves[3], Equals, cond.And[2].Not)
+}
+
+func (suite *ConditionTests) TestParseWords(c *C) {
+	cond, err := ParseCondition("not delete(/a) and create(/b/c-d_e.f) or members(/m) not in [1, 3)")
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.String(), Equals, "(!delete(/a) && create(/b/c-d_e.f)) || members(/m) not in [1, 3)")
+	c.Assert(cond.Or[1].Members.OutsideRange, Equals, true)
+	c.Assert(*cond.Or[1].Members.Max, Equals, int32(3))
+
+	for _, expr := range []string{
+		"members(/m) < 2",
+		"members(/m) == 2",
+		"members(/m) += -1",
+		"members(/m) in [0, 2)",
+		"!(create(/a) || create(/b))",
+	} {
+		cond, err := ParseCondition(expr)
+		c.Assert(err, Equals, nil)
+		c.Assert(cond.String(), Equals, expr)
+	}
+}
+
+func (suite *ConditionTests) TestParseErrors(c *C) {
+	for _, expr := range []string{
+		"",
+		"create(/a) &&",
+		"create(/a",
+		"create()",
+		"exists(/a)",
+		"members(/a)",
+		"members(/a) >= x",
+		"(create(/a) || delete(/b)",
+		"create(/a) delete(/b)",
+		"creates(/a)",
+	} {
+		_, err := ParseCondition(expr)
+		c.Assert(err, ErrorMatches, ErrBadCondition.Error()+": .*", Commentf("%s", expr))
+	}
+}
+
+func (suite *ConditionTests) TestEval(c *C) {
+	cond, err := ParseCondition("create(/a) && (create(/b) || !create(/c))")
+	c.Assert(err, Equals, nil)
+	eval := func(set ...string) bool {
+		return cond.Eval(func(leaf *Condition) bool {
+			for _, s := range set {
+				if leaf.Create.Path() == s {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	c.Assert(eval(), Equals, false)
+	c.Assert(eval("/a"), Equals, true)
+	c.Assert(eval("/a", "/c"), Equals, false)
+	c.Assert(eval("/a", "/b", "/c"), Equals, true)
+}
+
+func (suite *ConditionTests) TestNegated(c *C) {
+	cond, err := ParseCondition("create(/a) && (create(/b) || !(create(/c) && !delete(/d)))")
+	c.Assert(err, Equals, nil)
+	paths := []string{}
+	for _, leaf := range cond.Negated() {
+		paths = append(paths, leaf.String())
+	}
+	c.Assert(paths, DeepEquals, []string{"create(/c)", "delete(/d)"})
+}
+
+func (suite *ConditionTests) TestStable(c *C) {
+	cond, err := ParseCondition("create(/a) && (create(/b) || !create(/c)) for 1s && delete(/d) for 2s")
+	c.Assert(err, Equals, nil)
+	paths := []string{}
+	for _, leaf := range cond.Stable() {
+		paths = append(paths, leaf.String())
+	}
+	c.Assert(paths, DeepEquals, []string{"create(/b)", "create(/c)", "delete(/d) for 2s"})
+}
+
+func (suite *ConditionTests) TestJSON(c *C) {
+	conditions := Conditions{}
+	err := json.Unmarshal([]byte(`{
+		"create": "/ready",
+		"expr": {"or": [{"change": "/config"}, "members(/db) >= 2 && !create(/maintenance)"]}
+	}`), &conditions)
+	c.Assert(err, Equals, nil)
+	c.Assert(conditions.Expr.Validate(), Equals, nil)
+	c.Assert(conditions.Tree().String(), Equals,
+		"create(/ready) && (change(/config) || (members(/db) >= 2 && !create(/maintenance)))")
+
+	err = json.Unmarshal([]byte(`{"expr": "create(/a) ||"}`), &conditions)
+	c.Assert(err, ErrorMatches, ErrBadCondition.Error()+": .*")
+
+	c.Assert((&Condition{}).Validate(), Equals, ErrBadCondition)
+	create := Create("/a")
+	c.Assert((&Condition{Create: &create, Not: &Condition{Create: &create}}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Condition{And: []Condition{{}}}).Validate(), Equals, ErrBadCondition)
+}
+
+func (suite *ConditionTests) TestTree(c *C) {
+	a, b := Create("/a"), Delete("/b")
+	c.Assert((&Conditions{}).Tree(), IsNil)
+	c.Assert((&Conditions{Create: &a}).Tree().String(), Equals, "create(/a)")
+	c.Assert((&Conditions{Create: &a, Delete: &b}).Tree().String(), Equals, "create(/a) || delete(/b)")
+	c.Assert((&Conditions{Create: &a, Delete: &b, All: true}).Tree().String(), Equals, "create(/a) && delete(/b)")
+}
+
+func (suite *ConditionTests) TestStableFor(c *C) {
+	cond, err := ParseCondition("members(/db) >= 10 for 30s && !(create(/a) || create(/b)) for 1m0s")
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.Validate(), Equals, nil)
+	c.Assert(*cond.And[0].StableFor, Equals, Timeout(30*time.Second))
+	c.Assert(*cond.And[1].StableFor, Equals, Timeout(time.Minute))
+	c.Assert(cond.And[1].Not.StableFor, IsNil)
+	c.Assert(cond.String(), Equals, "members(/db) >= 10 for 30s && !(create(/a) || create(/b)) for 1m0s")
+
+	for _, expr := range []string{
+		`change(/app).status == "ready" for 5s`,
+		"(create(/a) && create(/b)) for 2s",
+		"(create(/a) for 1s) for 2s",
+		"!create(/a) for 1.5s",
+	} {
+		cond, err := ParseCondition(expr)
+		c.Assert(err, Equals, nil)
+		c.Assert(cond.String(), Equals, expr)
+	}
+	// The for applies to the negation
+	cond, err = ParseCondition("!create(/a) for 1.5s")
+	c.Assert(err, Equals, nil)
+	c.Assert(*cond.StableFor, Equals, Timeout(1500*time.Millisecond))
+	c.Assert(cond.Not.StableFor, IsNil)
+	c.Assert(cond.Validate(), Equals, nil)
+
+	// A stable_for directly under a negation is rejected
+	cond, err = ParseCondition("!(create(/a) for 1s)")
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.String(), Equals, "!(create(/a) for 1s)")
+	c.Assert(cond.Validate(), Equals, ErrBadCondition)
+
+	for _, expr := range []string{
+		"create(/a) for",
+		"create(/a) for 30",
+		"create(/a) for -1s",
+	} {
+		_, err := ParseCondition(expr)
+		c.Assert(err, ErrorMatches, ErrBadCondition.Error()+": .*", Commentf("%s", expr))
+	}
+
+	zero := Timeout(0)
+	create := Create("/a")
+	c.Assert((&Condition{Create: &create, StableFor: &zero}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Conditions{Create: &create, Debounce: &zero}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Conditions{Create: &create, StableFor: &zero}).Validate(), Equals, ErrBadCondition)
+
+	// Events cannot hold
+	for _, expr := range []string{
+		"change(/a) for 5s",
+		"change(/a).version changed for 5s",
+		"members(/db) += 1 for 5s",
+	} {
+		cond, err := ParseCondition(expr)
+		c.Assert(err, Equals, nil)
+		c.Assert(cond.Validate(), Equals, ErrBadCondition, Commentf("%s", expr))
+	}
+	second := Timeout(time.Second)
+	change := Change("/a")
+	c.Assert((&Conditions{Change: &change, StableFor: &second}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Conditions{Create: &create, StableFor: &second}).Validate(), Equals, nil)
+}
+
+func (suite *ConditionTests) TestStableForJSON(c *C) {
+	conditions := Conditions{}
+	err := json.Unmarshal([]byte(`{
+		"create": "/ready",
+		"stable_for": "10s",
+		"debounce": "500ms",
+		"expr": {"members": {"path": "/db", "min": 2}, "stable_for": "30s"}
+	}`), &conditions)
+	c.Assert(err, Equals, nil)
+	c.Assert(conditions.Validate(), Equals, nil)
+	c.Assert(*conditions.Debounce, Equals, Timeout(500*time.Millisecond))
+	c.Assert(conditions.Tree().String(), Equals, "(create(/ready) && members(/db) >= 2 for 30s) for 10s")
+
+	// The stable_for of the conditions does not change the expression
+	expr, err := ParseCondition("create(/a) for 1s")
+	c.Assert(err, Equals, nil)
+	conditions = Conditions{Expr: expr, StableFor: conditions.StableFor}
+	c.Assert(conditions.Tree().String(), Equals, "(create(/a) for 1s) for 10s")
+	c.Assert(expr.String(), Equals, "create(/a) for 1s")
+}
+
+func (suite *ConditionTests) TestEvalHold(c *C) {
+	cond, err := ParseCondition("create(/a) for 1s || create(/b)")
+	c.Assert(err, Equals, nil)
+	leaf := func(*Condition) bool { return true }
+
+	c.Assert(cond.Eval(leaf), Equals, true)
+
+	// Every node with a stable_for is held even if the or is already true
+	held := []string{}
+	hold := func(c *Condition, v bool) bool {
+		held = append(held, c.String())
+		return false
+	}
+	c.Assert(cond.Eval(leaf, hold), Equals, true)
+	c.Assert(held, DeepEquals, []string{"create(/a) for 1s"})
+
+	cond, err = ParseCondition("create(/a) for 1s && create(/b)")
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.Eval(leaf, hold), Equals, false)
+}
@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Op string
+
+const (
+	OpEquals         Op = "=="
+	OpNotEquals      Op = "!="
+	OpMatches        Op = "~" // regex
+	OpLess           Op = "<"
+	OpLessOrEqual    Op = "<="
+	OpGreater        Op = ">"
+	OpGreaterOrEqual Op = ">="
+	// The value is different from the value before the change
+	OpChanged Op = "changed"
+)
+
+var (
+	// Longest first for parsing
+	ops = []Op{OpEquals, OpNotEquals, OpLessOrEqual, OpGreaterOrEqual, OpLess, OpGreater, OpMatches}
+
+	field_regex = regexp.MustCompile(`^(\.[^.\s]+)+$`)
+)
+
+// A predicate on the value of a node after a change.  If Field is set, e.g. .status or
+// .build.branch, the value is parsed as JSON and the field is compared instead.  The numeric
+// ops compare the values as numbers.
+type Predicate struct {
+	Field string `json:"field,omitempty"`
+	Op    Op     `json:"op"`
+	Value string `json:"value,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+func (this *Predicate) Validate() error {
+	if this.Field != "" && !field_regex.MatchString(this.Field) {
+		return ErrBadCondition
+	}
+	switch this.Op {
+	case OpEquals, OpNotEquals, OpChanged:
+	case OpMatches:
+		if _, err := this.compiled(); err != nil {
+			return ErrBadCondition
+		}
+	case OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+		if _, err := strconv.ParseFloat(this.Value, 64); err != nil {
+			return ErrBadCondition
+		}
+	default:
+		return ErrBadCondition
+	}
+	return nil
+}
+
+// Compiles the regex of a match the first time.
+func (this *Predicate) compiled() (*regexp.Regexp, error) {
+	if this.regex == nil {
+		regex, err := regexp.Compile(this.Value)
+		if err != nil {
+			return nil, err
+		}
+		this.regex = regex
+	}
+	return this.regex, nil
+}
+
+// Returns true if the value after the change satisfies the predicate.  Before and after are
+// nil if the node did not exist.  Nothing matches a bad regex.
+func (this *Predicate) Met(before, after []byte) bool {
+	v, ok := this.select_(after)
+	if this.Op == OpChanged {
+		was, existed := this.select_(before)
+		return ok != existed || v != was
+	}
+	if !ok {
+		return false
+	}
+	switch this.Op {
+	case OpEquals:
+		return v == this.Value
+	case OpNotEquals:
+		return v != this.Value
+	case OpMatches:
+		regex, err := this.compiled()
+		return err == nil && regex.MatchString(v)
+	}
+
+	x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return false
+	}
+	y, _ := strconv.ParseFloat(this.Value, 64)
+	switch this.Op {
+	case OpLess:
+		return x < y
+	case OpLessOrEqual:
+		return x <= y
+	case OpGreater:
+		return x > y
+	case OpGreaterOrEqual:
+		return x >= y
+	}
+	return false
+}
+
+// Returns the value or the field as a string.  Fields that are not strings are in JSON.
+func (this *Predicate) select_(value []byte) (string, bool) {
+	if value == nil {
+		return "", false
+	}
+	if this.Field == "" {
+		return string(value), true
+	}
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(this.Field[1:], ".") {
+		switch o := v.(type) {
+		case map[string]interface{}:
+			var has bool
+			if v, has = o[key]; !has {
+				return "", false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(o) {
+				return "", false
+			}
+			v = o[i]
+		default:
+			return "", false
+		}
+	}
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	buff, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(buff), true
+}
+
+// Returns the expression form, e.g. .status == "ready"
+func (this *Predicate) String() string {
+	if this.Op == OpChanged {
+		return strings.TrimSpace(this.Field + " " + string(this.Op))
+	}
+	value := strconv.Quote(this.Value)
+	if _, err := strconv.ParseFloat(this.Value, 64); err == nil {
+		value = this.Value
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", this.Field, this.Op, value))
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func TestPredicate(t *testing.T) { TestingT(t) }
+
+type PredicateTests struct{}
+
+var _ = Suite(&PredicateTests{})
+
+func (suite *PredicateTests) TestValidate(c *C) {
+	c.Assert((&Predicate{Op: OpEquals, Value: "x"}).Validate(), Equals, nil)
+	c.Assert((&Predicate{Field: ".a.b", Op: OpChanged}).Validate(), Equals, nil)
+	c.Assert((&Predicate{Op: "=~"}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Predicate{Op: OpGreater, Value: "x"}).Validate(), Equals, ErrBadCondition)
+	c.Assert((&Predicate{Op: OpMatches, Value: "("}).Validate(), Equals, ErrBadCondition)
+	for _, field := range []string{"a", ".", ".a.", ".a..b"} {
+		c.Assert((&Predicate{Field: field, Op: OpEquals}).Validate(), Equals, ErrBadCondition)
+	}
+
+	change := Change("/app")
+	value := &Predicate{Field: ".status", Op: OpEquals, Value: "ready"}
+	c.Assert((&Conditions{Change: &change, Value: value}).Validate(), Equals, nil)
+	c.Assert((&Conditions{Value: value}).Validate(), Equals, ErrBadCondition)
+	value = &Predicate{Op: OpGreater, Value: "ready"}
+	c.Assert((&Conditions{Change: &change, Value: value}).Validate(), Equals, ErrBadCondition)
+}
+
+func (suite *PredicateTests) TestMet(c *C) {
+	value := []byte(`{"status":"ready","count":3,"ok":true,"hosts":["a","b"],"build":{"branch":"master"}}`)
+	for _, t := range []struct {
+		p   Predicate
+		met bool
+	}{
+		{Predicate{Field: ".status", Op: OpEquals, Value: "ready"}, true},
+		{Predicate{Field: ".status", Op: OpNotEquals, Value: "ready"}, false},
+		{Predicate{Field: ".build.branch", Op: OpMatches, Value: "^mast"}, true},
+		{Predicate{Field: ".count", Op: OpGreater, Value: "2"}, true},
+		{Predicate{Field: ".count", Op: OpLessOrEqual, Value: "2"}, false},
+		{Predicate{Field: ".ok", Op: OpEquals, Value: "true"}, true},
+		{Predicate{Field: ".hosts.1", Op: OpEquals, Value: "b"}, true},
+		{Predicate{Field: ".hosts.2", Op: OpEquals, Value: "c"}, false},
+		{Predicate{Field: ".missing", Op: OpNotEquals, Value: "x"}, false},
+		{Predicate{Field: ".status", Op: OpLess, Value: "1"}, false},
+	} {
+		c.Assert(t.p.Met(nil, value), Equals, t.met, Commentf("%s", t.p.String()))
+	}
+
+	c.Assert((&Predicate{Op: OpEquals, Value: "42"}).Met(nil, []byte("42")), Equals, true)
+	c.Assert((&Predicate{Op: OpGreaterOrEqual, Value: "42"}).Met(nil, []byte(" 42\n")), Equals, true)
+	c.Assert((&Predicate{Op: OpEquals, Value: ""}).Met(nil, nil), Equals, false)
+	c.Assert((&Predicate{Field: ".status", Op: OpEquals, Value: "ready"}).Met(nil, []byte("ready")), Equals, false)
+	c.Assert((&Predicate{Op: OpMatches, Value: "("}).Met(nil, []byte("(")), Equals, false)
+}
+
+func (suite *PredicateTests) TestChanged(c *C) {
+	p := Predicate{Field: ".version", Op: OpChanged}
+	c.Assert(p.Met([]byte(`{"version":1,"at":1}`), []byte(`{"version":1,"at":2}`)), Equals, false)
+	c.Assert(p.Met([]byte(`{"version":1,"at":1}`), []byte(`{"version":2,"at":1}`)), Equals, true)
+	c.Assert(p.Met([]byte(`{"at":1}`), []byte(`{"version":1}`)), Equals, true)
+	c.Assert(p.Met(nil, []byte(`{"version":1}`)), Equals, true)
+	c.Assert((&Predicate{Op: OpChanged}).Met([]byte("a"), []byte("a")), Equals, false)
+}
+
+func (suite *PredicateTests) TestParse(c *C) {
+	cond, err := ParseCondition(`change(/app).status == "ready" && change(/count) > 3`)
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.Validate(), Equals, nil)
+	c.Assert(*cond.And[0].Value, Equals, Predicate{Field: ".status", Op: OpEquals, Value: "ready"})
+	c.Assert(*cond.And[1].Value, Equals, Predicate{Op: OpGreater, Value: "3"})
+
+	for _, expr := range []string{
+		`change(/app).status == "ready"`,
+		`change(/tag) ~ "^v2\\.[0-9]+"`,
+		`change(/app).build.branch != "dev" || change(/app).version changed`,
+		`change(/app) changed`,
+		`change(/count) <= 10`,
+		`!change(/app)`,
+	} {
+		cond, err := ParseCondition(expr)
+		c.Assert(err, Equals, nil, Commentf("%s", expr))
+		c.Assert(cond.String(), Equals, expr)
+	}
+
+	cond, err = ParseCondition(`change(/app).enabled == true`)
+	c.Assert(err, Equals, nil)
+	c.Assert(cond.Value.Value, Equals, "true")
+	c.Assert(cond.Value.Met(nil, []byte(`{"enabled":true}`)), Equals, true)
+
+	for _, expr := range []string{
+		`change(/app).status`,
+		`change(/app) == `,
+		`change(/app) == "ready`,
+		`change(/app) > ready`,
+		`change(/app) ~ "("`,
+	} {
+		_, err := ParseCondition(expr)
+		c.Assert(err, ErrorMatches, ErrBadCondition.Error()+": .*", Commentf("%s", expr))
+	}
+}
+
+func (suite *PredicateTests) TestJSON(c *C) {
+	conditions := Conditions{}
+	err := json.Unmarshal([]byte(`{
+		"change": "/app",
+		"value": {"field": ".status", "op": "==", "value": "ready"}
+	}`), &conditions)
+	c.Assert(err, Equals, nil)
+	c.Assert(conditions.Validate(), Equals, nil)
+	c.Assert(conditions.Tree().String(), Equals, `change(/app).status == "ready"`)
+
+	c.Assert((&Conditions{Value: conditions.Value}).Validate(), Equals, ErrBadCondition)
+	create := Create("/a")
+	c.Assert((&Condition{Create: &create, Value: conditions.Value}).Validate(), Equals, ErrBadCondition)
+}
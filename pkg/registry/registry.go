@@ -48,13 +48,30 @@ func (this *Timeout) MarshalJSON() ([]byte, error) {
 type Conditions struct {
 	Timeout *Timeout `json:"timeout,omitempty"`
 
-	Create  *Create  `json:"create,omitempty"`  // if node created
-	Delete  *Delete  `json:"delete,omitempty"`  // if node deleted
-	Change  *Change  `json:"change,omitempty"`  // if node value changed
-	Members *Members `json:"members,omitempty"` // if node members changed
+	Create  *Create    `json:"create,omitempty"`  // if node created
+	Delete  *Delete    `json:"delete,omitempty"`  // if node deleted
+	Change  *Change    `json:"change,omitempty"`  // if node value changed
+	Value   *Predicate `json:"value,omitempty"`   // if the changed value satisfies the predicate
+	Members *Members   `json:"members,omitempty"` // if node members changed
 
 	// Default is ANY of the condition met will fire.
 	All bool `json:"all,omitempty"`
+
+	// The conditions must hold for this long before they fire.  See Condition.StableFor
+	StableFor *Timeout `json:"stable_for,omitempty"`
+
+	// Notifications from a watch within this interval are coalesced into one, e.g. for
+	// persistent watches on bursty children.
+	Debounce *Timeout `json:"debounce,omitempty"`
+
+	// Boolean tree of conditions, and'ed with the conditions above.
+	Expr *Condition `json:"expr,omitempty"`
+
+	// Evaluate the conditions against the current state first, then watch.  A create is true
+	// while the node exists, a delete while it does not, a change with a value predicate while
+	// the value satisfies it and members while the count is in range.  Default is to fire
+	// only on events after the watch is set.
+	Level bool `json:"level,omitempty"`
 }
 
 type Key interface {
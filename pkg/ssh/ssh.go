@@ -122,6 +122,43 @@ func (this *Client) RunCommandStdout(cmd string) ([]byte, error) {
 	return session.Output(cmd)
 }
 
+// Starts the command in a new session with the given streams.  The caller waits on and closes
+// the session.
+func (this *Client) Start(cmd string, stdin io.Reader, stdout, stderr io.Writer) (*ssh.Session, error) {
+	return this.StartWithEnv(cmd, nil, stdin, stdout, stderr)
+}
+
+// Sets the env entries (name=value) on the session before starting the command.  The server
+// must accept the names, e.g. with AcceptEnv in sshd_config.
+func (this *Client) StartWithEnv(cmd string, env []string, stdin io.Reader, stdout, stderr io.Writer) (*ssh.Session, error) {
+	session, err := this.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range env {
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		if err := session.Setenv(name, value); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (this *Client) Close() error {
+	return this.client.Close()
+}
+
 const (
 	SCP_PUSH_BEGIN_FILE = "C"
 	SCP_PUSH_END        = "\x00"
@@ -0,0 +1,167 @@
+package task
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	ControlCancel = "cancel"
+
+	// Name of the node under the task namespace that requests cancellation of the current run
+	// when written.  The value of the node can optionally name the signal, e.g. SIGINT.  Only
+	// the runtime running the command handles the node and deletes it so it does not cancel
+	// the runs after.  A node written before the run started is stale and is deleted.
+	cancel_node = "cancel"
+)
+
+// Message accepted on the control topic.  A plain text message "cancel" is also accepted.
+type ControlMessage struct {
+	Command string `json:"command"`
+	Signal  string `json:"signal,omitempty"`
+}
+
+var signals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// Parses signal names like SIGTERM or TERM.  Default is SIGTERM.
+func parse_signal(s string) syscall.Signal {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if strings.Index(name, "SIG") != 0 {
+		name = "SIG" + name
+	}
+	if sig, has := signals[name]; has {
+		return sig
+	}
+	return syscall.SIGTERM
+}
+
+// Cancels the task.  If the command is running, the signal is sent to its process group.
+// A trigger wait or a wait between retries is interrupted.  The task will not be retried and
+// ends with ErrCancelled.
+func (this *Runtime) Cancel(sig syscall.Signal) {
+	if atomic.CompareAndSwapInt32(&this.cancelled, 0, 1) {
+		close(this.cancelling)
+	}
+
+	this.cmd_lock.Lock()
+	executor := this.executor
+	var err error
+	if executor != nil {
+		err = executor.Signal(sig)
+	}
+	this.cmd_lock.Unlock()
+
+	switch {
+	case executor == nil:
+		this.Log("Cancel requested.  No process running.")
+	case err != nil:
+		this.Warn("Cannot signal", executor.Id(), "Err=", err.Error())
+	default:
+		this.Log("Cancel requested.  Sent", sig.String(), "to", executor.Id())
+	}
+}
+
+func (this *Runtime) is_cancelled() bool {
+	return atomic.LoadInt32(&this.cancelled) == 1
+}
+
+// True if the task can be cancelled remotely.
+func (this *Runtime) cancellable() bool {
+	return this.Task.Control != nil || (this.zk != nil && this.Namespace != nil)
+}
+
+// Listens on the control topic and the cancel node under the namespace.
+func (this *Runtime) start_control() {
+	if this.Task.Control != nil {
+		if c, err := this.Task.Control.Broker().PubSub(this.Id, this.options); err == nil {
+			if sub, err := c.Subscribe(*this.Task.Control); err == nil {
+				go func() {
+					for {
+						select {
+						case m := <-sub:
+							this.on_control(m)
+						case <-this.stopped:
+							return
+						}
+					}
+				}()
+			} else {
+				glog.Warningln("Cannot subscribe:", this.Task.Control.String(), "Err=", err)
+			}
+		} else {
+			glog.Warningln("Cannot subscribe:", this.Task.Control.String(), "Err=", err)
+		}
+	}
+
+	if this.zk != nil && this.Namespace != nil {
+		this.watch_cancel_node()
+	}
+}
+
+func (this *Runtime) on_control(m []byte) {
+	msg := ControlMessage{}
+	if err := json.Unmarshal(m, &msg); err != nil {
+		msg.Command = strings.TrimSpace(string(m))
+	}
+	switch msg.Command {
+	case ControlCancel:
+		this.Cancel(parse_signal(msg.Signal))
+	default:
+		this.Warn("Unknown control command:", msg.Command)
+	}
+}
+
+func (this *Runtime) watch_cancel_node() {
+	path := this.Namespace.Sub(cancel_node)
+	if this.cancel_if_requested(path) {
+		return
+	}
+	_, err := this.zk.Watch(path.Path(), func(e zk.Event) {
+		if this.is_done() {
+			return
+		}
+		if this.cancel_if_requested(path) {
+			return
+		}
+		this.watch_cancel_node()
+	})
+	if err != nil {
+		glog.Warningln("Cannot watch:", path, "Err=", err)
+	}
+}
+
+// Cancels if the cancel node was written since the current run started.  Runtimes that are
+// not running the command, e.g. a standby of an exclusive task, leave the node alone.  The
+// node is deleted first so the request is handled once.
+func (this *Runtime) cancel_if_requested(path registry.Path) bool {
+	state := this.State()
+	if state.Status != StatusRunning || (this.Workers == WorkersExclusive && !this.has_exclusive()) {
+		return false
+	}
+	n, err := this.zk.Get(path.Path())
+	if err != nil {
+		return false
+	}
+	if err := this.zk.Delete(path.Path()); err != nil {
+		glog.Warningln("Cannot delete:", path, "Err=", err)
+	}
+	if n.Stats != nil && n.Stats.Mtime/1000 < state.Since {
+		this.Log("Cleared cancel request from before the run.")
+		return false
+	}
+	this.Cancel(parse_signal(n.GetValueString()))
+	return true
+}
@@ -0,0 +1,125 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	. "gopkg.in/check.v1"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) { TestingT(t) }
+
+type CancelTests struct{}
+
+var _ = Suite(&CancelTests{})
+
+func (suite *CancelTests) TestParseSignal(c *C) {
+	c.Assert(parse_signal("SIGINT"), Equals, syscall.SIGINT)
+	c.Assert(parse_signal("kill"), Equals, syscall.SIGKILL)
+	c.Assert(parse_signal(""), Equals, syscall.SIGTERM)
+	c.Assert(parse_signal("bogus"), Equals, syscall.SIGTERM)
+}
+
+func (suite *CancelTests) TestCancelRunning(c *C) {
+	delay := registry.Timeout(10 * time.Millisecond)
+	runtime, err := (&Task{
+		Id:       "test-cancel",
+		Cmd:      &Cmd{Path: "sleep", Args: []string{"10"}},
+		ExecOnly: true,
+		Retry:    &RetryPolicy{MaxAttempts: 3, Delay: &delay},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+
+	time.Sleep(200 * time.Millisecond)
+	runtime.on_control([]byte(`{"command":"cancel","signal":"SIGINT"}`))
+
+	c.Assert(<-done, Equals, ErrCancelled)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	c.Assert(runtime.Stats.Cancelled > 0, Equals, true)
+	c.Assert(runtime.Stats.Attempts, Equals, 1) // not retried
+	c.Assert(runtime.Stats.Result.Signal, Equals, "interrupt")
+	c.Assert(runtime.Stats.Result.Error, Equals, ErrCancelled.Error())
+}
+
+func (suite *CancelTests) TestCancelBeforeExec(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-cancel-before",
+		Cmd:      &Cmd{Path: "echo"},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	// Logging blocks until the runtime is started
+	go func() { runtime.on_control([]byte("cancel")) }()
+	for !runtime.is_cancelled() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = runtime.Start()
+	c.Assert(err, Equals, ErrCancelled)
+}
+
+func (suite *CancelTests) TestCancelBetweenRetries(c *C) {
+	delay := registry.Timeout(10 * time.Second)
+	runtime, err := (&Task{
+		Id:       "test-cancel-retry",
+		Cmd:      &Cmd{Path: "bash", Args: []string{"-c", "exit 1"}},
+		ExecOnly: true,
+		Retry:    &RetryPolicy{MaxAttempts: 3, Delay: &delay},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+
+	time.Sleep(200 * time.Millisecond)
+	runtime.Cancel(syscall.SIGTERM)
+
+	c.Assert(<-done, Equals, ErrCancelled)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	c.Assert(runtime.Stats.Attempts, Equals, 1)
+}
+
+func (suite *CancelTests) TestCancelNode(c *C) {
+	namespace := registry.Path("/unit-test/cancel-node")
+	runtime, err := (&Task{
+		Id:        "test-cancel-node",
+		Namespace: &namespace,
+		Cmd:       &Cmd{Path: "echo"},
+		ExecOnly:  true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	path := namespace.Sub(cancel_node)
+	request := func() {
+		runtime.zk = &fake_zk{nodes: map[string]*zk.Node{path.Path(): {
+			Path:  path.Path(),
+			Value: []byte("SIGINT"),
+			Stats: &gozk.Stat{Mtime: time.Now().Unix() * 1000},
+		}}}
+	}
+
+	// Left for the runtime running the command
+	request()
+	c.Assert(runtime.cancel_if_requested(path), Equals, false)
+	c.Assert(zk.PathExists(runtime.zk, path), Equals, true)
+
+	// A request from before the run is cleared
+	runtime.state = RuntimeState{Status: StatusRunning, Since: time.Now().Unix() + 10}
+	c.Assert(runtime.cancel_if_requested(path), Equals, false)
+	c.Assert(zk.PathExists(runtime.zk, path), Equals, false)
+	c.Assert(runtime.is_cancelled(), Equals, false)
+
+	request()
+	runtime.state.Since = time.Now().Unix() - 10
+	c.Assert(runtime.cancel_if_requested(path), Equals, true)
+	c.Assert(zk.PathExists(runtime.zk, path), Equals, false)
+	c.Assert(runtime.is_cancelled(), Equals, true)
+}
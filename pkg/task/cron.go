@@ -0,0 +1,421 @@
+package task
+
+import (
+	"fmt"
+	"github.com/qorio/maestro/pkg/zk"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported shorthands in addition to the standard 5 field (minute hour dom month dow)
+// and 6 field (second minute hour dom month dow) expressions.
+var cron_shorthands = map[string]CronExpression{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+var (
+	cron_months = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	cron_weekdays = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+type cron_field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	field_second  = cron_field{name: "second", min: 0, max: 59}
+	field_minute  = cron_field{name: "minute", min: 0, max: 59}
+	field_hour    = cron_field{name: "hour", min: 0, max: 23}
+	field_dom     = cron_field{name: "day-of-month", min: 1, max: 31}
+	field_month   = cron_field{name: "month", min: 1, max: 12, names: cron_months}
+	field_weekday = cron_field{name: "day-of-week", min: 0, max: 7, names: cron_weekdays}
+)
+
+// A parsed cron expression.  Each field is a bitmask of the allowed values.
+type Cron struct {
+	expression CronExpression
+
+	second  uint64
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	weekday uint64
+
+	// True if the field was given as * or ?.  This matters for the day-of-month / day-of-week
+	// rule:  if both are restricted, a day matches if EITHER matches.
+	dom_any     bool
+	weekday_any bool
+
+	// For @every <duration>
+	every time.Duration
+}
+
+// Parses the expression.  Supported forms:
+//
+//	minute hour day-of-month month day-of-week
+//	second minute hour day-of-month month day-of-week
+//	@yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly
+//	@every <duration>  e.g. @every 1h30m
+func (this CronExpression) Parse() (*Cron, error) {
+	expr := strings.TrimSpace(string(this))
+	if len(expr) == 0 {
+		return nil, ErrBadCron
+	}
+
+	if strings.Index(expr, "@every") == 0 {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every"):]))
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%s: %s: %s", ErrBadCron, expr, err)
+		case d < time.Second:
+			return nil, fmt.Errorf("%s: %s: interval must be at least 1s", ErrBadCron, expr)
+		}
+		return &Cron{expression: this, every: d}, nil
+	}
+
+	if strings.Index(expr, "@") == 0 {
+		long, has := cron_shorthands[strings.ToLower(expr)]
+		if !has {
+			return nil, fmt.Errorf("%s: %s: unknown shorthand", ErrBadCron, expr)
+		}
+		parsed, err := long.Parse()
+		if err != nil {
+			return nil, err
+		}
+		parsed.expression = this
+		return parsed, nil
+	}
+
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("%s: %s: expected 5 or 6 fields, got %d", ErrBadCron, expr, len(fields))
+	}
+
+	cron := &Cron{expression: this}
+	var err error
+	if cron.second, _, err = parse_cron_field(fields[0], field_second); err != nil {
+		return nil, err
+	}
+	if cron.minute, _, err = parse_cron_field(fields[1], field_minute); err != nil {
+		return nil, err
+	}
+	if cron.hour, _, err = parse_cron_field(fields[2], field_hour); err != nil {
+		return nil, err
+	}
+	if cron.dom, cron.dom_any, err = parse_cron_field(fields[3], field_dom); err != nil {
+		return nil, err
+	}
+	if cron.month, _, err = parse_cron_field(fields[4], field_month); err != nil {
+		return nil, err
+	}
+	if cron.weekday, cron.weekday_any, err = parse_cron_field(fields[5], field_weekday); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if cron.weekday&(1<<7) != 0 {
+		cron.weekday |= 1
+	}
+	return cron, nil
+}
+
+func (this CronExpression) String() string {
+	return string(this)
+}
+
+// Parses a single field which is a comma separated list of values, ranges and steps.
+// Returns the bitmask and whether the field is unrestricted.
+func parse_cron_field(s string, f cron_field) (bits uint64, any bool, err error) {
+	for _, part := range strings.Split(s, ",") {
+		b, err := parse_cron_range(part, f)
+		if err != nil {
+			return 0, false, err
+		}
+		bits |= b
+	}
+	return bits, s == "*" || s == "?", nil
+}
+
+// Handles: *, ?, n, n-m, */step, n-m/step, n/step
+func parse_cron_range(s string, f cron_field) (uint64, error) {
+	bad := func(reason string) error {
+		return fmt.Errorf("%s: %s field %q: %s", ErrBadCron, f.name, s, reason)
+	}
+
+	step := 1
+	spec := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		v, err := strconv.Atoi(s[i+1:])
+		if err != nil || v <= 0 {
+			return 0, bad("bad step")
+		}
+		step = v
+		spec = s[:i]
+	}
+
+	start, end := f.min, f.max
+	switch {
+	case spec == "*" || spec == "?":
+	case strings.Index(spec, "-") > 0:
+		i := strings.Index(spec, "-")
+		var err error
+		if start, err = cron_value(spec[:i], f); err != nil {
+			return 0, bad(err.Error())
+		}
+		if end, err = cron_value(spec[i+1:], f); err != nil {
+			return 0, bad(err.Error())
+		}
+	default:
+		v, err := cron_value(spec, f)
+		if err != nil {
+			return 0, bad(err.Error())
+		}
+		start = v
+		if step == 1 {
+			end = v // a single value
+		}
+	}
+
+	switch {
+	case start < f.min, end > f.max:
+		return 0, bad(fmt.Sprintf("out of range [%d,%d]", f.min, f.max))
+	case start > end:
+		return 0, bad("range start after end")
+	}
+
+	bits := uint64(0)
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func cron_value(s string, f cron_field) (int, error) {
+	if f.names != nil {
+		if v, has := f.names[strings.ToLower(s)]; has {
+			return v, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("not a number")
+	}
+	return v, nil
+}
+
+func (this *Cron) String() string {
+	return string(this.expression)
+}
+
+// Returns the next time after t that satisfies the schedule.  A zero time is returned if
+// no such time can be found (e.g. Feb 30).
+func (this *Cron) Next(t time.Time) time.Time {
+	if this.every > 0 {
+		return t.Add(this.every - time.Duration(t.Nanosecond())*time.Nanosecond)
+	}
+
+	loc := t.Location()
+
+	// Start at the next whole second
+	t = t.Add(time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
+	limit := t.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+
+	for !has_bit(this.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !this.day_matches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for !has_bit(this.hour, t.Hour()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for !has_bit(this.minute, t.Minute()) {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	for !has_bit(this.second, t.Second()) {
+		t = t.Truncate(time.Second).Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+	return t
+}
+
+func (this *Cron) day_matches(t time.Time) bool {
+	dom := has_bit(this.dom, t.Day())
+	dow := has_bit(this.weekday, int(t.Weekday()))
+	if this.dom_any || this.weekday_any {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has_bit(bits uint64, i int) bool {
+	return bits&(1<<uint(i)) != 0
+}
+
+func (this *Trigger) ordering() TriggerOrder {
+	if this.Order == "" {
+		return CronGatedByRegistry
+	}
+	return this.Order
+}
+
+func (this *Trigger) Validate() error {
+	switch this.ordering() {
+	case CronGatedByRegistry, RegistryArmsCron:
+	default:
+		return ErrBadConfigTrigger
+	}
+	if this.Cron != nil {
+		if _, err := this.Cron.Parse(); err != nil {
+			return err
+		}
+	}
+	if this.Registry != nil {
+		if err := this.Registry.Validate(); err != nil {
+			return ErrBadConfigTrigger
+		}
+	}
+	if this.PubSub != nil {
+		if this.Cron != nil {
+			return ErrBadConfigTrigger
+		}
+		return this.PubSub.Validate()
+	}
+	return nil
+}
+
+// Runs the task each time the cron schedule fires, taking into account the ordering with
+// respect to any registry conditions.  The returned channel receives the result of each run
+// and is closed when the runtime is stopped or the schedule is exhausted.  It holds the last
+// result; an older result that is not read by then is dropped so the schedule is not held up.
+// A run that is still in progress when the next fire time comes around will cause that fire
+// to be skipped.  A fire whose registry trigger fails, e.g. on timeout, is skipped.
+func (this *Runtime) start_cron() (chan error, error) {
+	cron, err := this.Trigger.Cron.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	gated := this.Trigger.Registry != nil && this.Trigger.ordering() == CronGatedByRegistry
+	if this.Trigger.Registry != nil && this.Trigger.ordering() == RegistryArmsCron {
+		switch err := this.wait_registry(); {
+		case err == zk.ErrTimeout:
+			return nil, ErrTimeout
+		case err != nil:
+			return nil, err
+		}
+		this.Log("Cron armed:", cron.String())
+	}
+
+	results := make(chan error, 1)
+	go func() {
+		defer close(results)
+		for {
+			next := cron.Next(time.Now())
+			if next.IsZero() {
+				this.Log("Cron schedule exhausted:", cron.String())
+				return
+			}
+			this.set_state(StatusWaiting, nil)
+			this.Log("Next run at", next.Format(time.RFC3339))
+
+			select {
+			case <-time.After(next.Sub(time.Now())):
+			case <-this.cancelling:
+				this.Log("Cancelled.  Stopping cron schedule:", cron.String())
+				return
+			case <-this.stopped:
+				return
+			}
+
+			if gated {
+				switch err := this.wait_registry(); {
+				case err == ErrCancelled:
+					this.Log("Cancelled.  Stopping cron schedule:", cron.String())
+					return
+				case err == ErrStopped:
+					return
+				case err != nil:
+					this.Log("Trigger failed:", err.Error(), "Skipping run scheduled at", next.Format(time.RFC3339))
+					continue
+				}
+			} else {
+				this.Stats.Triggered = this.Now()
+			}
+
+			var result error
+			if done, err := this.exec(); err != nil {
+				result = err
+			} else {
+				result = <-done
+			}
+
+			// The older result is replaced if not read so the channel holds the last result.
+			// This is the only sender so there is room once the old result is gone.
+			select {
+			case results <- result:
+			case <-this.stopped:
+				return
+			default:
+				select {
+				case dropped := <-results:
+					this.Warn("Cron result not read. Dropped:", dropped)
+				default:
+				}
+				results <- result
+			}
+
+			if this.is_cancelled() {
+				this.Log("Cancelled.  Stopping cron schedule:", cron.String())
+				return
+			}
+			if this.is_exclusive_lost() {
+				this.Warn("Exclusive lock lost.  Stopping cron schedule:", cron.String())
+				return
+			}
+		}
+	}()
+	return results, nil
+}
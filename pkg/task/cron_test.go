@@ -0,0 +1,116 @@
+package task
+
+import (
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) { TestingT(t) }
+
+type CronTests struct{}
+
+var _ = Suite(&CronTests{})
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04:05", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (suite *CronTests) TestParseErrors(c *C) {
+	for _, bad := range []CronExpression{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"foo * * * *",
+		"@sometimes",
+		"@every 10ms",
+		"@every forever",
+	} {
+		_, err := bad.Parse()
+		c.Assert(err, Not(Equals), nil, Commentf("expression=%s", bad))
+	}
+}
+
+func (suite *CronTests) TestNextFiveFields(c *C) {
+	cron, err := CronExpression("30 2 * * *").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 01:00:00")), Equals, at("2015-06-10 02:30:00"))
+	c.Assert(cron.Next(at("2015-06-10 02:30:00")), Equals, at("2015-06-11 02:30:00"))
+
+	cron, err = CronExpression("*/15 9-17 * * mon-fri").Parse()
+	c.Assert(err, Equals, nil)
+	// Saturday --> Monday morning
+	c.Assert(cron.Next(at("2015-06-13 12:00:00")), Equals, at("2015-06-15 09:00:00"))
+	c.Assert(cron.Next(at("2015-06-15 09:00:00")), Equals, at("2015-06-15 09:15:00"))
+	c.Assert(cron.Next(at("2015-06-15 17:45:00")), Equals, at("2015-06-16 09:00:00"))
+
+	cron, err = CronExpression("0 0 1 jan,jul *").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-02-01 00:00:00")), Equals, at("2015-07-01 00:00:00"))
+	c.Assert(cron.Next(at("2015-07-01 00:00:00")), Equals, at("2016-01-01 00:00:00"))
+}
+
+func (suite *CronTests) TestNextSeconds(c *C) {
+	cron, err := CronExpression("*/10 * * * * *").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 01:00:01")), Equals, at("2015-06-10 01:00:10"))
+	c.Assert(cron.Next(at("2015-06-10 01:00:59")), Equals, at("2015-06-10 01:01:00"))
+}
+
+func (suite *CronTests) TestDayOfMonthOrDayOfWeek(c *C) {
+	// Both restricted:  either the 13th or any Friday
+	cron, err := CronExpression("0 0 13 * 5").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-01 00:00:00")), Equals, at("2015-06-05 00:00:00"))
+	c.Assert(cron.Next(at("2015-06-12 00:00:00")), Equals, at("2015-06-13 00:00:00"))
+
+	// Sunday as 7
+	cron, err = CronExpression("0 0 * * 7").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 00:00:00")), Equals, at("2015-06-14 00:00:00"))
+
+	// Never
+	cron, err = CronExpression("0 0 30 2 *").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 00:00:00")).IsZero(), Equals, true)
+}
+
+func (suite *CronTests) TestShorthands(c *C) {
+	cron, err := CronExpression("@daily").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 13:14:15")), Equals, at("2015-06-11 00:00:00"))
+	c.Assert(cron.String(), Equals, "@daily")
+
+	cron, err = CronExpression("@hourly").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 13:14:15")), Equals, at("2015-06-10 14:00:00"))
+
+	cron, err = CronExpression("@weekly").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 13:14:15")), Equals, at("2015-06-14 00:00:00"))
+
+	cron, err = CronExpression("@every 90s").Parse()
+	c.Assert(err, Equals, nil)
+	c.Assert(cron.Next(at("2015-06-10 13:14:15")), Equals, at("2015-06-10 13:15:45"))
+}
+
+func (suite *CronTests) TestTriggerValidate(c *C) {
+	cron := CronExpression("@every 1m")
+	c.Assert((&Trigger{Cron: &cron}).Validate(), Equals, nil)
+	c.Assert((&Trigger{Cron: &cron, Order: RegistryArmsCron}).Validate(), Equals, nil)
+	c.Assert((&Trigger{Cron: &cron, Order: "whenever"}).Validate(), Equals, ErrBadConfigTrigger)
+
+	bad := CronExpression("* * *")
+	c.Assert((&Trigger{Cron: &bad}).Validate(), Not(Equals), nil)
+}
@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	_docker "github.com/fsouza/go-dockerclient"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/docker"
+	"github.com/qorio/maestro/pkg/task"
+	"syscall"
+	"time"
+)
+
+const (
+	// Microseconds
+	cpu_period = 100000
+)
+
+var (
+	ErrNotStarted        = errors.New("not-started")
+	ErrStdinNotSupported = errors.New("stdin-not-supported")
+)
+
+func init() {
+	task.RegisterExecutor(task.ExecutorDocker, NewExecutor)
+}
+
+// Runs the command in a new container and streams the container's logs to the task.
+type executor struct {
+	config    *task.DockerConfig
+	docker    *docker.Docker
+	container *docker.Container
+	logs      chan error
+	start     time.Time
+}
+
+func NewExecutor(cmd *task.Cmd) (task.Executor, error) {
+	if cmd.Docker == nil || cmd.Docker.Endpoint == "" || cmd.Docker.Image == "" {
+		return nil, task.ErrBadConfigExecutor
+	}
+	return &executor{config: cmd.Docker}, nil
+}
+
+func (this *executor) Start(spec *task.ExecSpec) (err error) {
+	if spec.Stdin != nil {
+		return ErrStdinNotSupported
+	}
+	if this.config.Cert != "" {
+		this.docker, err = docker.NewTLSClient(this.config.Endpoint, this.config.Cert, this.config.Key, this.config.Ca)
+	} else {
+		this.docker, err = docker.NewClient(this.config.Endpoint)
+	}
+	if err != nil {
+		return err
+	}
+
+	config := &_docker.Config{
+		Image:        this.config.Image,
+		Env:          spec.Env,
+		WorkingDir:   spec.Cmd.Dir,
+		Cmd:          spec.Cmd.Args,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	if spec.Cmd.Path != "" {
+		config.Entrypoint = []string{spec.Cmd.Path}
+	}
+	if spec.Cmd.RunAs != nil {
+		config.User = fmt.Sprintf("%d:%d", spec.Cmd.RunAs.Uid, spec.Cmd.RunAs.Gid)
+	}
+
+	// A container that is created but fails to start is not returned
+	var created *docker.Container
+	this.docker.ContainerCreated = func(c *docker.Container) { created = c }
+
+	this.start = time.Now()
+	this.container, err = this.docker.StartContainer(nil, &docker.ContainerControl{
+		Config:     config,
+		RunOnce:    true,
+		HostConfig: host_config(spec.Cmd.Limits),
+	})
+	if err != nil {
+		if created != nil {
+			this.container = created
+			this.remove()
+			this.container = nil
+		}
+		return err
+	}
+	glog.Infoln("Started container", this.container.Id, "image=", this.config.Image)
+
+	this.logs = make(chan error, 1)
+	go func() {
+		this.logs <- this.docker.FollowLogs(nil, this.container.Id, spec.Stdout, spec.Stderr)
+	}()
+	return nil
+}
+
+func (this *executor) Wait() (*task.ExecResult, error) {
+	result := &task.ExecResult{ExitCode: -1}
+	if this.container == nil {
+		return result, ErrNotStarted
+	}
+	defer this.remove()
+
+	code, err := this.docker.WaitContainer(nil, this.container.Id)
+	result.WallTimeMs = int64(time.Since(this.start) / time.Millisecond)
+	if err != nil {
+		return result, err
+	}
+	// The log stream ends when the container stops
+	if err := <-this.logs; err != nil {
+		glog.Warningln("Error streaming logs of container", this.container.Id, "Err=", err)
+	}
+	result.ExitCode = code
+	if this.container.Inspect() == nil && this.container.DockerData.State.OOMKilled {
+		return result, task.ErrLimitMemory
+	}
+	if code != 0 {
+		return result, task.ErrExecFailed
+	}
+	return result, nil
+}
+
+func (this *executor) Signal(sig syscall.Signal) error {
+	if this.container == nil {
+		return nil
+	}
+	return this.docker.KillContainer(nil, this.container.Id, sig)
+}
+
+func (this *executor) Id() string {
+	if this.container == nil {
+		return ""
+	}
+	return this.container.Id
+}
+
+// Only the cgroup limits map to the container.  The container runtime sets the rlimits.
+func host_config(limits *task.ResourceLimits) *_docker.HostConfig {
+	config := &_docker.HostConfig{}
+	if limits == nil {
+		return config
+	}
+	if limits.OpenFiles > 0 || limits.CpuSeconds > 0 || limits.AddressSpace > 0 || limits.Nice != 0 {
+		glog.Warningln("Rlimits and nice are not supported for containers.  Ignored.")
+	}
+	if limits.Cgroup != nil {
+		config.Memory = int64(limits.Cgroup.MemoryMax)
+		if limits.Cgroup.CpuMax > 0 {
+			config.CPUPeriod = cpu_period
+			config.CPUQuota = int64(limits.Cgroup.CpuMax * cpu_period)
+		}
+	}
+	return config
+}
+
+func (this *executor) remove() {
+	if this.config.Keep {
+		return
+	}
+	if err := this.docker.RemoveContainer(nil, this.container.Id, true, true); err != nil {
+		glog.Warningln("Cannot remove container", this.container.Id, "Err=", err)
+	}
+}
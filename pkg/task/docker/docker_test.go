@@ -0,0 +1,31 @@
+package docker
+
+import (
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func TestDocker(t *testing.T) { TestingT(t) }
+
+type DockerExecutorTests struct{}
+
+var _ = Suite(&DockerExecutorTests{})
+
+func (suite *DockerExecutorTests) TestNewExecutor(c *C) {
+	_, err := NewExecutor(&task.Cmd{Path: "echo", Executor: task.ExecutorDocker})
+	c.Assert(err, Equals, task.ErrBadConfigExecutor)
+
+	_, err = NewExecutor(&task.Cmd{Path: "echo", Docker: &task.DockerConfig{Endpoint: "unix:///var/run/docker.sock"}})
+	c.Assert(err, Equals, task.ErrBadConfigExecutor)
+
+	e, err := NewExecutor(&task.Cmd{Path: "echo", Docker: &task.DockerConfig{
+		Endpoint: "unix:///var/run/docker.sock",
+		Image:    "busybox",
+	}})
+	c.Assert(err, Equals, nil)
+	c.Assert(e.Id(), Equals, "")
+
+	_, err = e.Wait()
+	c.Assert(err, Equals, ErrNotStarted)
+}
@@ -0,0 +1,202 @@
+package task
+
+import (
+	"fmt"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	exclusive_dir       = "exclusive"
+	exclusive_member    = "member-"
+	exclusive_completed = "completed"
+)
+
+// Blocks until this runtime holds the exclusive lock under the task namespace.  Each runtime
+// creates an ephemeral sequential node and the one with the lowest sequence number holds the
+// lock.  The others watch the node just ahead of them so that when the holder's session dies,
+// the next in line takes over.  Returns ErrCompletedByPeer if the holder completed the task
+// while this runtime was standing by.  A task completed before this runtime registered was
+// an earlier run and does not count.  Once acquired, the lock is watched.  See watch_exclusive.
+func (this *Runtime) wait_exclusive() error {
+	dir := this.Namespace.Sub(exclusive_dir)
+
+	host, _ := os.Hostname()
+	node, err := this.zk.CreateEphemeralSequential(dir.Sub(exclusive_member).Path(),
+		[]byte(fmt.Sprintf("%s:%d", host, os.Getpid())))
+	if err != nil {
+		return err
+	}
+	this.set_exclusive(node)
+	atomic.StoreInt32(&this.exclusive_lost, 0)
+	this.Log("Exclusive: registered as", node.GetBasename())
+
+	for {
+		if marker, err := this.zk.Get(dir.Sub(exclusive_completed).Path()); err == nil && completed_after(marker, node) {
+			this.release_exclusive(false)
+			this.Log("Exclusive: task completed by peer")
+			return ErrCompletedByPeer
+		}
+
+		members, err := exclusive_members(this.zk, dir)
+		if err != nil {
+			return err
+		}
+		i := sort.SearchStrings(members, node.GetBasename())
+		switch {
+		case i == len(members) || members[i] != node.GetBasename():
+			// Our node is gone, e.g. the session expired while waiting.
+			this.set_exclusive(nil)
+			return ErrExclusiveLost
+		case i == 0:
+			this.Log("Exclusive: acquired")
+			this.watch_exclusive(node)
+			return nil
+		}
+
+		ahead := dir.Sub(members[i-1])
+		this.Log("Exclusive: standing by behind", ahead.Base())
+
+		changed := make(chan bool, 1)
+		watch_stop, err := this.zk.Watch(ahead.Path(), func(e zk.Event) {
+			changed <- true
+		})
+		if err != nil {
+			return err
+		}
+		// The node ahead may have gone away before the watch was set.
+		if !zk.PathExists(this.zk, ahead) {
+			watch_stop <- true
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-this.stopped:
+			watch_stop <- true
+			return ErrStopped
+		}
+	}
+}
+
+// True if the completed marker was set after the member node was created.
+func completed_after(marker, member *zk.Node) bool {
+	if marker.Stats == nil || member.Stats == nil {
+		return false
+	}
+	return marker.Stats.Mzxid > member.Stats.Czxid
+}
+
+func (this *Runtime) set_exclusive(node *zk.Node) {
+	this.exclusive_lock.Lock()
+	defer this.exclusive_lock.Unlock()
+	this.exclusive = node
+}
+
+func (this *Runtime) has_exclusive() bool {
+	this.exclusive_lock.Lock()
+	defer this.exclusive_lock.Unlock()
+	return this.exclusive != nil
+}
+
+func (this *Runtime) holds_exclusive(node *zk.Node) bool {
+	this.exclusive_lock.Lock()
+	defer this.exclusive_lock.Unlock()
+	return node != nil && this.exclusive == node
+}
+
+// Watches the lock node while held.  If it is gone or cannot be read, e.g. the session
+// expired, a peer may take over so the lock is lost and the running command is killed.
+func (this *Runtime) watch_exclusive(node *zk.Node) {
+	_, err := this.zk.Watch(node.GetPath(), func(e zk.Event) {
+		if !this.holds_exclusive(node) {
+			return // released
+		}
+		if _, err := this.zk.Get(node.GetPath()); err == nil {
+			this.watch_exclusive(node)
+			return
+		}
+		this.lose_exclusive()
+	})
+	if err != nil {
+		this.Warn("Exclusive: cannot watch", node.GetPath(), "Err=", err.Error())
+		this.lose_exclusive()
+	}
+}
+
+func (this *Runtime) lose_exclusive() {
+	atomic.StoreInt32(&this.exclusive_lost, 1)
+	this.set_exclusive(nil)
+
+	this.cmd_lock.Lock()
+	defer this.cmd_lock.Unlock()
+	if this.executor == nil {
+		this.Warn("Exclusive: lock lost.")
+		return
+	}
+	this.Warn("Exclusive: lock lost.  Sending SIGKILL to", this.executor.Id())
+	if err := this.executor.Signal(syscall.SIGKILL); err != nil {
+		this.Warn("Cannot signal", this.executor.Id(), "Err=", err.Error())
+	}
+}
+
+func (this *Runtime) is_exclusive_lost() bool {
+	return atomic.LoadInt32(&this.exclusive_lost) == 1
+}
+
+// Returns the sorted names of the member nodes.
+func exclusive_members(zkc zk.ZK, dir registry.Path) ([]string, error) {
+	n, err := zkc.Get(dir.Path())
+	if err != nil {
+		return nil, err
+	}
+	children, err := n.Children()
+	if err != nil {
+		return nil, err
+	}
+	members := []string{}
+	for _, c := range children {
+		if strings.Index(c.GetBasename(), exclusive_member) == 0 {
+			members = append(members, c.GetBasename())
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// Releases the lock, if held.  If completed, the peers standing by will not run the task.
+func (this *Runtime) release_exclusive(completed bool) {
+	this.exclusive_lock.Lock()
+	node := this.exclusive
+	this.exclusive = nil
+	this.exclusive_lock.Unlock()
+
+	if node == nil {
+		return
+	}
+	if completed {
+		marker := this.Namespace.Sub(exclusive_dir, exclusive_completed)
+		if err := zk.CreateOrSetString(this.zk, marker, fmt.Sprintf("%d", this.Now())); err != nil {
+			this.Warn("Exclusive: cannot mark completed", marker.Path(), "Err=", err.Error())
+		}
+	}
+	if err := zk.DeleteObject(this.zk, registry.Path(node.GetPath())); err != nil {
+		this.Warn("Exclusive: cannot release", node.GetPath(), "Err=", err.Error())
+	}
+}
+
+// Forwards the result and releases the lock, marking the task as completed if it succeeded.
+func (this *Runtime) complete_exclusive(done chan error) chan error {
+	forward := make(chan error)
+	go func() {
+		result := <-done
+		this.release_exclusive(result == nil)
+		forward <- result
+	}()
+	return forward
+}
@@ -0,0 +1,58 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func TestExclusive(t *testing.T) { TestingT(t) }
+
+type ExclusiveTests struct{}
+
+var _ = Suite(&ExclusiveTests{})
+
+func (suite *ExclusiveTests) TestValidate(c *C) {
+	t := Task{
+		Id:       "test-exclusive",
+		Cmd:      &Cmd{Path: "echo"},
+		LogTopic: "mqtt://localhost:1883/test/exclusive",
+		Workers:  WorkersExclusive,
+	}
+	c.Assert(t.Validate(), Equals, ErrBadConfigExclusive)
+
+	ns := registry.Path("/unit-test/exclusive")
+	t.Namespace = &ns
+	c.Assert(t.Validate(), Equals, nil)
+
+	t.Workers = "scheduler"
+	c.Assert(t.Validate(), Equals, ErrBadConfigWorkers)
+}
+
+func (suite *ExclusiveTests) TestCompletedAfter(c *C) {
+	member := &zk.Node{Stats: &gozk.Stat{Czxid: 10}}
+
+	// Completed by the holder while standing by
+	c.Assert(completed_after(&zk.Node{Stats: &gozk.Stat{Mzxid: 12}}, member), Equals, true)
+
+	// Marker from an earlier run
+	c.Assert(completed_after(&zk.Node{Stats: &gozk.Stat{Mzxid: 8}}, member), Equals, false)
+	c.Assert(completed_after(&zk.Node{}, member), Equals, false)
+}
+
+func (suite *ExclusiveTests) TestRequiresZk(c *C) {
+	ns := registry.Path("/unit-test/exclusive")
+	runtime, err := (&Task{
+		Id:        "test-exclusive",
+		Cmd:       &Cmd{Path: "echo"},
+		LogTopic:  "mqtt://localhost:1883/test/exclusive",
+		Namespace: &ns,
+		Workers:   WorkersExclusive,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	_, err = runtime.Start()
+	c.Assert(err, Equals, ErrBadConfigExclusive)
+}
@@ -1,7 +1,6 @@
 package task
 
 import (
-	. "github.com/qorio/maestro/pkg/registry"
 	. "gopkg.in/check.v1"
 	"testing"
 )
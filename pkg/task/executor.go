@@ -0,0 +1,208 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrUnknownExecutor = errors.New("unknown-executor")
+
+	executors      = map[ExecutorType]ExecutorFactory{}
+	executors_lock sync.Mutex
+)
+
+// What to run and where the streams go.  Cmd has the substitutions applied and Env has
+// the resolved values.
+type ExecSpec struct {
+	Cmd    *Cmd
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Run the command in its own process group, if supported.
+	ProcessGroup bool
+
+	// Names of the env entries resolved from the registry, e.g. secrets.  These must not be
+	// passed where they can be seen, like on a command line.
+	Resolved []string
+}
+
+// Runs one command.  A new executor is created for each attempt.
+type Executor interface {
+	Start(spec *ExecSpec) error
+
+	// Blocks until the command exits.  The result is never nil.  The error is nil only if
+	// the command exited with code 0.
+	Wait() (*ExecResult, error)
+
+	// Used for timeouts and cancellation.
+	Signal(sig syscall.Signal) error
+
+	// Identifies the running command, e.g. a pid or a container id.
+	Id() string
+}
+
+type ExecutorFactory func(cmd *Cmd) (Executor, error)
+
+// Registers the executor for the given type.  Executors other than local are registered by
+// their packages, e.g. import _ "github.com/qorio/maestro/pkg/task/ssh"
+func RegisterExecutor(t ExecutorType, factory ExecutorFactory) {
+	executors_lock.Lock()
+	defer executors_lock.Unlock()
+	executors[t] = factory
+}
+
+func (this *Cmd) executor() ExecutorType {
+	if this.Executor == "" {
+		return ExecutorLocal
+	}
+	return this.Executor
+}
+
+// Checks the config of a remote executor.  The command path is not checked since it is not
+// on the local machine.
+func (this *Cmd) validate_executor() error {
+	switch this.executor() {
+	case ExecutorDocker:
+		if this.Docker == nil || this.Docker.Endpoint == "" || this.Docker.Image == "" {
+			return ErrBadConfigExecutor
+		}
+	case ExecutorSSH:
+		if this.SSH == nil || this.SSH.Host == "" {
+			return ErrBadConfigExecutor
+		}
+	}
+	return nil
+}
+
+func new_executor(cmd *Cmd) (Executor, error) {
+	executors_lock.Lock()
+	factory, has := executors[cmd.executor()]
+	executors_lock.Unlock()
+	if !has {
+		return nil, fmt.Errorf("%s: %s", ErrUnknownExecutor, cmd.executor())
+	}
+	return factory(cmd)
+}
+
+func init() {
+	RegisterExecutor(ExecutorLocal, func(cmd *Cmd) (Executor, error) {
+		return new(local_executor), nil
+	})
+}
+
+// Runs the command as a child process.
+type local_executor struct {
+	cmd    *exec.Cmd
+	limits *ResourceLimits
+	cgroup string
+	start  time.Time
+}
+
+func (this *local_executor) Start(spec *ExecSpec) error {
+	var gate *os.File
+	if spec.Cmd.Limits != nil {
+		var err error
+		if this.cmd, gate, err = gated_command(spec.Cmd); err != nil {
+			return err
+		}
+		this.limits = spec.Cmd.Limits
+	} else {
+		this.cmd = exec.Command(spec.Cmd.Path, spec.Cmd.Args...)
+	}
+	this.cmd.Dir = spec.Cmd.Dir
+	this.cmd.Env = spec.Env
+	this.cmd.Stdout = spec.Stdout
+	this.cmd.Stderr = spec.Stderr
+
+	if spec.Stdin != nil {
+		// Unlike setting cmd.Stdin, the pipe is closed when the process exits so Wait
+		// does not block on input that never comes.
+		wr, err := this.cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(wr, spec.Stdin)
+			wr.Close()
+			if c, ok := spec.Stdin.(io.Closer); ok {
+				c.Close()
+			}
+		}()
+	}
+
+	if spec.ProcessGroup {
+		set_process_group(this.cmd)
+	}
+	if spec.Cmd.RunAs != nil {
+		if this.cmd.SysProcAttr == nil {
+			this.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		this.cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: spec.Cmd.RunAs.Uid,
+			Gid: spec.Cmd.RunAs.Gid,
+		}
+	}
+	this.start = time.Now()
+	err := this.cmd.Start()
+	if gate == nil {
+		return err
+	}
+	return this.open_gate(gate, err)
+}
+
+// Applies the limits to the gated process and lets it exec the command.  The process is
+// killed if the limits cannot be applied.
+func (this *local_executor) open_gate(gate *os.File, err error) error {
+	defer gate.Close()
+	this.cmd.ExtraFiles[0].Close()
+	if err != nil {
+		return err
+	}
+	this.cgroup, err = apply_limits(this.cmd.Process.Pid, this.limits)
+	if err != nil {
+		this.cmd.Process.Kill()
+		this.cmd.Wait()
+		remove_cgroup(this.cgroup)
+		return err
+	}
+	return nil
+}
+
+func (this *local_executor) Wait() (*ExecResult, error) {
+	err := this.cmd.Wait()
+	result := new_exec_result(this.cmd.ProcessState, time.Since(this.start))
+	defer remove_cgroup(this.cgroup)
+
+	if limit_err := limit_error(this.limits, this.cgroup, this.cmd.ProcessState); limit_err != nil {
+		return result, limit_err
+	}
+	switch {
+	case err != nil:
+		return result, err
+	case this.cmd.ProcessState == nil:
+		return result, ErrCommandUnknown
+	case !this.cmd.ProcessState.Success():
+		return result, ErrExecFailed
+	}
+	return result, nil
+}
+
+func (this *local_executor) Signal(sig syscall.Signal) error {
+	return signal_process_group(this.cmd, sig)
+}
+
+func (this *local_executor) Id() string {
+	if this.cmd == nil || this.cmd.Process == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", this.cmd.Process.Pid)
+}
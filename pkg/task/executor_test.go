@@ -0,0 +1,133 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExecutor(t *testing.T) { TestingT(t) }
+
+type ExecutorTests struct{}
+
+var _ = Suite(&ExecutorTests{})
+
+// Echoes the args to stdout without running anything.
+type echo_executor struct {
+	spec *ExecSpec
+}
+
+func (this *echo_executor) Start(spec *ExecSpec) error {
+	this.spec = spec
+	return nil
+}
+
+func (this *echo_executor) Wait() (*ExecResult, error) {
+	fmt.Fprintln(this.spec.Stdout, strings.Join(this.spec.Cmd.Args, " "))
+	if this.spec.Cmd.Path == "fail" {
+		return &ExecResult{ExitCode: 3}, ErrExecFailed
+	}
+	return &ExecResult{}, nil
+}
+
+func (this *echo_executor) Signal(sig syscall.Signal) error {
+	return nil
+}
+
+func (this *echo_executor) Id() string {
+	return "echo"
+}
+
+func init() {
+	RegisterExecutor("echo", func(cmd *Cmd) (Executor, error) {
+		return new(echo_executor), nil
+	})
+}
+
+func (suite *ExecutorTests) TestLocal(c *C) {
+	e, err := new_executor(&Cmd{Path: "cat"})
+	c.Assert(err, Equals, nil)
+
+	stdout := new(bytes.Buffer)
+	err = e.Start(&ExecSpec{
+		Cmd:    &Cmd{Path: "cat"},
+		Stdin:  strings.NewReader("hello"),
+		Stdout: stdout,
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(e.Id(), Not(Equals), "")
+
+	result, err := e.Wait()
+	c.Assert(err, Equals, nil)
+	c.Assert(result.ExitCode, Equals, 0)
+	c.Assert(stdout.String(), Equals, "hello")
+
+	e, err = new_executor(&Cmd{Path: "bash", Args: []string{"-c", "exit 2"}})
+	c.Assert(err, Equals, nil)
+	c.Assert(e.Start(&ExecSpec{Cmd: &Cmd{Path: "bash", Args: []string{"-c", "exit 2"}}}), Equals, nil)
+	result, err = e.Wait()
+	c.Assert(err, Not(Equals), nil)
+	c.Assert(result.ExitCode, Equals, 2)
+}
+
+func (suite *ExecutorTests) TestUnknown(c *C) {
+	_, err := new_executor(&Cmd{Path: "echo", Executor: "mainframe"})
+	c.Assert(err, ErrorMatches, "unknown-executor: mainframe")
+
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-executor-unknown",
+		Cmd: &Cmd{Path: "echo", Executor: "mainframe"},
+	})
+	c.Assert(err, ErrorMatches, "unknown-executor: mainframe")
+	c.Assert(runtime.Stats.Result.ExitCode, Equals, -1)
+}
+
+func (suite *ExecutorTests) TestValidate(c *C) {
+	c.Assert((&Cmd{Path: "echo", Executor: ExecutorDocker}).validate_executor(), Equals, ErrBadConfigExecutor)
+	c.Assert((&Cmd{Path: "echo", Executor: ExecutorSSH, SSH: &SSHConfig{}}).validate_executor(), Equals, ErrBadConfigExecutor)
+	c.Assert((&Cmd{Path: "echo", Executor: ExecutorSSH, SSH: &SSHConfig{Host: "h"}}).validate_executor(), Equals, nil)
+
+	// The command only has to exist on the remote side
+	_, err := (&Task{
+		Id:       "test-executor-validate",
+		ExecOnly: true,
+		Cmd: &Cmd{
+			Path:     "/not/on/this/host",
+			Executor: ExecutorDocker,
+			Docker:   &DockerConfig{Endpoint: "unix:///var/run/docker.sock", Image: "busybox"},
+		},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	// Nor a pubsub payload on stdin
+	_, err = (&Task{
+		Id:       "test-executor-validate",
+		ExecOnly: true,
+		Cmd: &Cmd{
+			Path:     "cat",
+			Executor: ExecutorDocker,
+			Docker:   &DockerConfig{Endpoint: "unix:///var/run/docker.sock", Image: "busybox"},
+		},
+		Trigger: &Trigger{PubSub: &PubSubTrigger{Topic: "kfka://local:1/t"}},
+	}).Init(nil)
+	c.Assert(err, Equals, ErrBadConfigExecutor)
+}
+
+func (suite *ExecutorTests) TestCustom(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-executor-custom",
+		Cmd: &Cmd{Path: "echo", Args: []string{"hello", "world"}, Executor: "echo"},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, "hello world\n")
+
+	runtime, err = run_exec_only(c, Task{
+		Id:  "test-executor-custom-fail",
+		Cmd: &Cmd{Path: "fail", Executor: "echo"},
+	})
+	c.Assert(err, Equals, ErrExecFailed)
+	c.Assert(runtime.Stats.Result.ExitCode, Equals, 3)
+}
@@ -0,0 +1,126 @@
+package task
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	_template "github.com/qorio/maestro/pkg/template"
+	"github.com/qorio/maestro/pkg/zk"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultFileMode os.FileMode = 0644
+)
+
+func (this *File) Validate() error {
+	if this.Template == "" || this.Path == "" {
+		return ErrBadConfigFiles
+	}
+	if this.Mode != "" {
+		if _, err := strconv.ParseUint(this.Mode, 8, 32); err != nil {
+			return ErrBadConfigFiles
+		}
+	}
+	return nil
+}
+
+func (this *File) mode() os.FileMode {
+	if this.Mode == "" {
+		return DefaultFileMode
+	}
+	m, _ := strconv.ParseUint(this.Mode, 8, 32)
+	return os.FileMode(m)
+}
+
+// Applies the env to the template urls and destination paths.  Inline string:// templates
+// are left for rendering.
+func (this *Runtime) apply_files(env map[string]interface{}) error {
+	for i, f := range this.Files {
+		if strings.Index(f.Template, "string://") != 0 {
+			url, err := apply(f.Template, env, nil)
+			if err != nil {
+				return err
+			}
+			this.Files[i].Template = url
+		}
+		path, err := apply(f.Path, env, nil)
+		if err != nil {
+			return err
+		}
+		this.Files[i].Path = path
+	}
+	return nil
+}
+
+// Renders the files for the run.  The template data is the env applied to the task and the
+// resolved env of the command.  Files already written are removed if one fails.
+func (this *Runtime) render_files() error {
+	if len(this.Files) == 0 {
+		return nil
+	}
+	data := map[string]interface{}{}
+	for k, v := range this.context {
+		data[k] = v
+	}
+	if this.Cmd != nil {
+		env, err := this.resolve_env()
+		if err != nil {
+			return err
+		}
+		for _, kv := range env {
+			if eq := strings.Index(kv, "="); eq > 0 {
+				data[kv[:eq]] = kv[eq+1:]
+			}
+		}
+	}
+	for _, f := range this.Files {
+		if err := this.render_file(f, data); err != nil {
+			this.remove_files()
+			return fmt.Errorf("%s: %s", f.Path, err)
+		}
+	}
+	return nil
+}
+
+func (this *Runtime) render_file(f File, data map[string]interface{}) error {
+	if strings.Index(f.Template, zk.PrefixZk) == 0 && this.zk == nil {
+		return ErrNoRegistry
+	}
+	funcs := []template.FuncMap{}
+	if this.funcs != nil {
+		funcs = append(funcs, template.FuncMap(this.funcs))
+	}
+	content, err := _template.ExecuteUrl(this.zk, f.Template, "", data, funcs...)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.Path, content, f.mode()); err != nil {
+		return err
+	}
+	// The mode is not changed by WriteFile if the file exists
+	if err := os.Chmod(f.Path, f.mode()); err != nil {
+		return err
+	}
+	if !f.Persistent {
+		this.rendered = append(this.rendered, f.Path)
+	}
+	glog.Infoln("Task", this.Id, "rendered", f.Template, "to", f.Path)
+	return nil
+}
+
+func (this *Runtime) remove_files() {
+	for _, path := range this.rendered {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Warningln("Task", this.Id, "cannot remove", path, "Err=", err)
+		}
+	}
+	this.rendered = nil
+}
@@ -0,0 +1,96 @@
+package task
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFiles(t *testing.T) { TestingT(t) }
+
+type FilesTests struct{}
+
+var _ = Suite(&FilesTests{})
+
+func (suite *FilesTests) TestValidate(c *C) {
+	c.Assert((&File{Template: "string://x", Path: "/tmp/x"}).Validate(), Equals, nil)
+	c.Assert((&File{Template: "string://x"}).Validate(), Equals, ErrBadConfigFiles)
+	c.Assert((&File{Template: "string://x", Path: "/tmp/x", Mode: "0999"}).Validate(), Equals, ErrBadConfigFiles)
+	c.Assert((&File{Mode: "0600"}).mode(), Equals, os.FileMode(0600))
+	c.Assert((&File{}).mode(), Equals, DefaultFileMode)
+}
+
+func (suite *FilesTests) TestRenderAndCleanup(c *C) {
+	dir := c.MkDir()
+	conf := filepath.Join(dir, "conf", "app.conf")
+	keep := filepath.Join(dir, "keep.conf")
+
+	task := Task{
+		Id: "test-files",
+		Cmd: &Cmd{
+			Path: "cat",
+			Args: []string{conf, keep},
+			Env:  []string{"PORT=8080"},
+		},
+		Files: []File{
+			{Template: "string://port={{.PORT}}\n", Path: filepath.Join(dir, "{{.Dir}}", "app.conf"), Mode: "0600"},
+			{Template: "string://host={{.Host}}\n", Path: keep, Persistent: true},
+		},
+		ExecOnly: true,
+	}
+	runtime, err := task.Init(nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.ApplyEnvAndFuncs(map[string]interface{}{"Dir": "conf", "Host": "db1"}, nil), Equals, nil)
+	runtime.CaptureStdout()
+
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, "port=8080\nhost=db1\n")
+
+	_, err = os.Stat(conf)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	buff, err := ioutil.ReadFile(keep)
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buff), Equals, "host=db1\n")
+}
+
+func (suite *FilesTests) TestMode(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "secret")
+	runtime := &Runtime{Task: Task{Id: "test-files-mode"}}
+	c.Assert(runtime.render_file(File{Template: "string://s3cret", Path: path, Mode: "0600"}, nil), Equals, nil)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, Equals, nil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Assert(runtime.rendered, DeepEquals, []string{path})
+
+	runtime.remove_files()
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (suite *FilesTests) TestRenderError(c *C) {
+	dir := c.MkDir()
+	first := filepath.Join(dir, "first")
+	runtime, err := (&Task{
+		Id:  "test-files-error",
+		Cmd: &Cmd{Path: "echo"},
+		Files: []File{
+			{Template: "string://ok", Path: first},
+			{Template: "zk:///templates/missing", Path: filepath.Join(dir, "second")},
+		},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	_, err = runtime.Start()
+	c.Assert(err, ErrorMatches, ".*second: "+ErrNoRegistry.Error())
+	c.Assert(runtime.State().Status, Equals, StatusError)
+
+	_, err = os.Stat(first)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
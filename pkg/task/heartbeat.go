@@ -0,0 +1,307 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/zk"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeatInterval = 10 * time.Second
+
+	// Prefix of the progress lines on stdout
+	ProgressMarker = "##progress "
+	// Env of the command with the path of the progress socket
+	ProgressSocketEnv = "MAESTRO_PROGRESS_SOCKET"
+
+	heartbeat_node = "heartbeat"
+	progress_key   = "progress"
+
+	// Longer lines are not progress lines and are passed through
+	max_progress_line = 4096
+)
+
+// Written to the heartbeat node under the namespace at each interval.  Id is the pid or the
+// container id of the command.
+type HeartbeatInfo struct {
+	Id       string    `json:"id"`
+	Run      int       `json:"run,omitempty"`
+	Time     int64     `json:"time"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+func (this *Heartbeat) Validate(cmd *Cmd) error {
+	if this.Interval != nil && *this.Interval <= 0 {
+		return ErrBadConfigHeartbeat
+	}
+	if this.Socket && cmd != nil && cmd.executor() != ExecutorLocal {
+		return ErrBadConfigHeartbeat
+	}
+	return nil
+}
+
+func (this *Heartbeat) interval() time.Duration {
+	if this.Interval == nil {
+		return DefaultHeartbeatInterval
+	}
+	return time.Duration(*this.Interval)
+}
+
+// Parses "<percent> <message>".
+func parse_progress(line string) (*Progress, bool) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, false
+	}
+	progress := &Progress{Percent: percent, Time: time.Now().Unix()}
+	if len(fields) == 2 {
+		progress.Message = strings.TrimSpace(fields[1])
+	}
+	return progress, true
+}
+
+// Returns the last progress reported by the command, or nil.
+func (this *Runtime) Progress() *Progress {
+	this.progress_lock.Lock()
+	defer this.progress_lock.Unlock()
+	return this.progress
+}
+
+func (this *Runtime) set_progress(progress *Progress) {
+	this.progress_lock.Lock()
+	defer this.progress_lock.Unlock()
+	this.progress = progress
+}
+
+// Logs and announces the last progress.
+func (this *Runtime) publish_progress() {
+	progress := this.Progress()
+	if progress == nil {
+		return
+	}
+	this.Log("Progress", progress.Percent, progress.Message)
+	this.Announce() <- Announce{
+		Key:   progress_key,
+		Value: *progress,
+	}
+}
+
+// Passes the output through without the progress lines.  The start of a line is held while it
+// can still be a progress line.  A line that does not parse is passed through.
+type progress_writer struct {
+	heartbeat *heartbeat
+	writer    io.Writer
+	line      bytes.Buffer
+	plain     bool // the rest of the line is passed through
+}
+
+func (this *progress_writer) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch {
+		case this.plain:
+			out = append(out, b)
+			this.plain = b != '\n'
+		case b == '\n':
+			line := this.line.String()
+			this.line.Reset()
+			if strings.Index(line, ProgressMarker) == 0 {
+				if progress, ok := parse_progress(line[len(ProgressMarker):]); ok {
+					this.heartbeat.report(progress)
+					continue
+				}
+			}
+			out = append(append(out, line...), b)
+		default:
+			this.line.WriteByte(b)
+			line := this.line.String()
+			if this.line.Len() > max_progress_line ||
+				!(strings.Index(ProgressMarker, line) == 0 || strings.Index(line, ProgressMarker) == 0) {
+				out = append(out, line...)
+				this.line.Reset()
+				this.plain = true
+			}
+		}
+	}
+	if len(out) > 0 {
+		if _, err := this.writer.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Passes through what is held when the output ends without a newline.
+func (this *progress_writer) flush() {
+	if this.line.Len() > 0 {
+		this.writer.Write(this.line.Bytes())
+		this.line.Reset()
+	}
+}
+
+type heartbeat struct {
+	runtime  *Runtime
+	stdout   *progress_writer
+	dir      string
+	listener net.Listener
+	stop     chan bool
+	wg       sync.WaitGroup
+
+	// Signals a new progress to publish.  The output of the command is not held up by
+	// the publishing, and progress reported in the meantime is skipped.
+	reported chan bool
+}
+
+// Sets up the progress reporting for the command.  Returns nil if the task has no heartbeat.
+// The socket, if any, is added to the env of the command.
+func (this *Runtime) prepare_heartbeat(spec *ExecSpec) (*heartbeat, error) {
+	if this.Heartbeat == nil {
+		return nil, nil
+	}
+	this.set_progress(nil)
+
+	hb := &heartbeat{runtime: this, stop: make(chan bool), reported: make(chan bool, 1)}
+	hb.stdout = &progress_writer{heartbeat: hb, writer: spec.Stdout}
+	spec.Stdout = hb.stdout
+
+	hb.wg.Add(1)
+	go func() {
+		defer hb.wg.Done()
+		for {
+			select {
+			case <-hb.reported:
+				this.publish_progress()
+			case <-hb.stop:
+				select {
+				case <-hb.reported:
+					this.publish_progress()
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	if !this.Heartbeat.Socket {
+		return hb, nil
+	}
+	dir, err := ioutil.TempDir("", "maestro-")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "progress.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	hb.dir, hb.listener = dir, listener
+
+	// A nil env is the env of the process, which is kept
+	env := spec.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	spec.Env = append(append([]string{}, env...), ProgressSocketEnv+"="+socket)
+
+	hb.wg.Add(1)
+	go func() {
+		defer hb.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			hb.wg.Add(1)
+			go func() {
+				defer hb.wg.Done()
+				hb.read_progress(conn)
+			}()
+		}
+	}()
+	return hb, nil
+}
+
+func (this *heartbeat) read_progress(conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		// Unblocks the read when the heartbeat stops
+		<-this.stop
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), ProgressMarker)
+		if progress, ok := parse_progress(line); ok {
+			this.report(progress)
+		}
+	}
+}
+
+func (this *heartbeat) report(progress *Progress) {
+	this.runtime.set_progress(progress)
+	select {
+	case this.reported <- true:
+	default:
+	}
+}
+
+// Writes the heartbeat node until stopped.
+func (this *heartbeat) start(id string) {
+	runtime := this.runtime
+	if runtime.zk == nil || runtime.Namespace == nil {
+		return
+	}
+	path := runtime.Namespace.Sub(heartbeat_node)
+	beat := func() {
+		info := HeartbeatInfo{Id: id, Time: runtime.Now(), Progress: runtime.Progress()}
+		if runtime.run != nil {
+			info.Run = runtime.run.Seq
+		}
+		if err := zk.CreateOrSet(runtime.zk, path, info, true); err != nil {
+			glog.Warningln("Task", runtime.Id, "cannot write heartbeat. Err=", err)
+		}
+	}
+	beat()
+
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		ticker := time.NewTicker(runtime.Heartbeat.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				beat()
+			case <-this.stop:
+				if err := zk.DeleteObject(runtime.zk, path); err != nil {
+					glog.Warningln("Task", runtime.Id, "cannot delete heartbeat. Err=", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (this *heartbeat) close() {
+	this.stdout.flush()
+	close(this.stop)
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	this.wg.Wait()
+	if this.dir != "" {
+		os.RemoveAll(this.dir)
+	}
+}
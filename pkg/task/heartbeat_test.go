@@ -0,0 +1,125 @@
+package task
+
+import (
+	"bytes"
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) { TestingT(t) }
+
+type HeartbeatTests struct{}
+
+var _ = Suite(&HeartbeatTests{})
+
+func (suite *HeartbeatTests) TestValidate(c *C) {
+	zero := registry.Timeout(0)
+	c.Assert((&Heartbeat{Socket: true}).Validate(&Cmd{Path: "echo"}), Equals, nil)
+	c.Assert((&Heartbeat{Interval: &zero}).Validate(&Cmd{Path: "echo"}), Equals, ErrBadConfigHeartbeat)
+	c.Assert((&Heartbeat{Socket: true}).Validate(&Cmd{Path: "echo", Executor: ExecutorSSH}), Equals, ErrBadConfigHeartbeat)
+	c.Assert((&Heartbeat{}).interval(), Equals, DefaultHeartbeatInterval)
+}
+
+func (suite *HeartbeatTests) TestParseProgress(c *C) {
+	p, ok := parse_progress("40 copied users")
+	c.Assert(ok, Equals, true)
+	c.Assert(p.Percent, Equals, 40.)
+	c.Assert(p.Message, Equals, "copied users")
+
+	p, ok = parse_progress("12.5%")
+	c.Assert(ok, Equals, true)
+	c.Assert(p.Percent, Equals, 12.5)
+	c.Assert(p.Message, Equals, "")
+
+	_, ok = parse_progress("lots done")
+	c.Assert(ok, Equals, false)
+	_, ok = parse_progress("140 done")
+	c.Assert(ok, Equals, false)
+}
+
+func run_heartbeat_task(c *C, heartbeat *Heartbeat, script string) *Runtime {
+	runtime, err := (&Task{
+		Id:        "test-heartbeat",
+		Cmd:       &Cmd{Path: "bash", Args: []string{"-c", script}},
+		ExecOnly:  true,
+		Heartbeat: heartbeat,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	runtime.CaptureStdout()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, nil)
+	return runtime
+}
+
+func (suite *HeartbeatTests) TestStdoutProgress(c *C) {
+	runtime := run_heartbeat_task(c, &Heartbeat{},
+		`echo "##progress 10 started"; echo -n "##progress 50"; echo " halfway"; echo "##progress x"`)
+
+	progress := runtime.Progress()
+	c.Assert(progress, Not(IsNil))
+	c.Assert(progress.Percent, Equals, 50.)
+	c.Assert(progress.Message, Equals, "halfway")
+	c.Assert(progress.Time >= time.Now().Unix()-5, Equals, true)
+
+	// The progress lines are taken out of the output
+	c.Assert(runtime.Stats.Result.Output, Equals, "##progress x\n")
+}
+
+func (suite *HeartbeatTests) TestProgressWriter(c *C) {
+	var buff bytes.Buffer
+	runtime := &Runtime{}
+	hb := &heartbeat{runtime: runtime, reported: make(chan bool, 1)}
+	w := &progress_writer{heartbeat: hb, writer: &buff}
+
+	w.Write([]byte("##prog"))
+	c.Assert(buff.String(), Equals, "")
+	w.Write([]byte("ress 30 a\n##x\n{\"a\":1}"))
+	c.Assert(buff.String(), Equals, "##x\n{\"a\":1}")
+	c.Assert(runtime.Progress().Percent, Equals, 30.)
+
+	// A long line without a newline is not held
+	buff.Reset()
+	w.Write([]byte("\n" + ProgressMarker + strings.Repeat("x", max_progress_line)))
+	c.Assert(buff.Len(), Equals, 1+len(ProgressMarker)+max_progress_line)
+
+	// Nor is the end of the output
+	buff.Reset()
+	w.Write([]byte("\n##pro"))
+	w.flush()
+	c.Assert(buff.String(), Equals, "\n##pro")
+}
+
+func (suite *HeartbeatTests) TestSocketKeepsEnv(c *C) {
+	runtime := run_heartbeat_task(c, &Heartbeat{Socket: true}, `echo $PATH`)
+	c.Assert(runtime.Stats.Result.Output, Equals, os.Getenv("PATH")+"\n")
+}
+
+func (suite *HeartbeatTests) TestSocketProgress(c *C) {
+	runtime := run_heartbeat_task(c, &Heartbeat{Socket: true},
+		`perl -MIO::Socket::UNIX -e '
+			my $s = IO::Socket::UNIX->new(Peer => $ENV{MAESTRO_PROGRESS_SOCKET}) or die;
+			print $s "20 indexing\n";
+			print $s "##progress 75 migrating orders\n";
+			close $s;
+		' && sleep 0.2 && echo $MAESTRO_PROGRESS_SOCKET`)
+
+	progress := runtime.Progress()
+	c.Assert(progress, Not(IsNil))
+	c.Assert(progress.Percent, Equals, 75.)
+	c.Assert(progress.Message, Equals, "migrating orders")
+	c.Assert(runtime.Stats.Result.Output, Matches, ".*/progress.sock\n")
+
+	// The socket is removed once the command exits
+	_, err := os.Stat(strings.TrimSpace(runtime.Stats.Result.Output))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (suite *HeartbeatTests) TestNoHeartbeat(c *C) {
+	runtime := run_heartbeat_task(c, nil, `echo "##progress 10 started"`)
+	c.Assert(runtime.Progress(), IsNil)
+}
@@ -0,0 +1,156 @@
+package task
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultCgroupParent = "/sys/fs/cgroup/maestro"
+
+	// Period for cpu.max in microseconds
+	cgroup_cpu_period = 100000
+
+	// Holds the command in a shell until the parent closes fd 3.  The shell then execs the
+	// command, which keeps the pid and the limits set on the shell.
+	limits_gate = `read _ <&3; exec 3<&-; exec "$@"`
+)
+
+var (
+	ErrLimitsNotSupported = errors.New("limits-not-supported")
+)
+
+// Builds the command so that it does not run until the limits are applied.  The returned
+// file is the write end of the gate;  closing it releases the command.
+func gated_command(cmd *Cmd) (*exec.Cmd, *os.File, error) {
+	path, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	gated := exec.Command("/bin/sh", append([]string{"-c", limits_gate, "sh", path}, cmd.Args...)...)
+	gated.ExtraFiles = []*os.File{r}
+	return gated, w, nil
+}
+
+func (this *ResourceLimits) Validate() error {
+	switch {
+	case this.Nice < -20 || this.Nice > 19:
+		return ErrBadConfigLimits
+	case this.Cgroup != nil && this.Cgroup.CpuMax < 0:
+		return ErrBadConfigLimits
+	}
+	return nil
+}
+
+func (this *CgroupLimits) parent() string {
+	if this.Parent == "" {
+		return DefaultCgroupParent
+	}
+	return this.Parent
+}
+
+// Applies the limits to a process that is held at the gate.  Returns the cgroup created for
+// the process, if any.  The cgroup is removed by remove_cgroup once the process exits.
+func apply_limits(pid int, limits *ResourceLimits) (string, error) {
+	if err := set_rlimits(pid, limits); err != nil {
+		return "", err
+	}
+	if limits.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, limits.Nice); err != nil {
+			return "", err
+		}
+	}
+	if limits.Cgroup == nil {
+		return "", nil
+	}
+	return join_cgroup(pid, limits.Cgroup)
+}
+
+// Creates a cgroup for the process with the memory and cpu caps and moves the process into it.
+func join_cgroup(pid int, limits *CgroupLimits) (string, error) {
+	dir := filepath.Join(limits.parent(), fmt.Sprintf("task-%d", pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if limits.MemoryMax > 0 {
+		if err := write_cgroup(dir, "memory.max", fmt.Sprintf("%d", limits.MemoryMax)); err != nil {
+			return dir, err
+		}
+	}
+	if limits.CpuMax > 0 {
+		quota := int64(limits.CpuMax * cgroup_cpu_period)
+		if err := write_cgroup(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cgroup_cpu_period)); err != nil {
+			return dir, err
+		}
+	}
+	return dir, write_cgroup(dir, "cgroup.procs", fmt.Sprintf("%d", pid))
+}
+
+func write_cgroup(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// True if the kernel killed a process in the cgroup for going over memory.max.
+func cgroup_oom_killed(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.Atoi(fields[1])
+			return err == nil && n > 0
+		}
+	}
+	return false
+}
+
+func remove_cgroup(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		glog.Warningln("Cannot remove cgroup", dir, "Err=", err)
+	}
+}
+
+// Returns the error for a process that was killed for going over a limit, or nil.  Going
+// over the cpu time results in SIGXCPU and SIGKILL a second later if still running.
+func limit_error(limits *ResourceLimits, cgroup string, ps *os.ProcessState) error {
+	if limits == nil || ps == nil {
+		return nil
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return nil
+	}
+	cpu := ps.UserTime() + ps.SystemTime()
+	switch {
+	case ws.Signal() == syscall.SIGXCPU:
+		return ErrLimitCpu
+	case ws.Signal() != syscall.SIGKILL:
+		return nil
+	case cgroup != "" && cgroup_oom_killed(cgroup):
+		return ErrLimitMemory
+	case limits.CpuSeconds > 0 && cpu >= time.Duration(limits.CpuSeconds)*time.Second:
+		return ErrLimitCpu
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package task
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The hard cpu limit is a second over the soft limit so the process gets SIGXCPU first.
+func set_rlimits(pid int, limits *ResourceLimits) error {
+	if limits.OpenFiles > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, limits.OpenFiles, limits.OpenFiles); err != nil {
+			return err
+		}
+	}
+	if limits.CpuSeconds > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_CPU, limits.CpuSeconds, limits.CpuSeconds+1); err != nil {
+			return err
+		}
+	}
+	if limits.AddressSpace > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, limits.AddressSpace, limits.AddressSpace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, soft, hard uint64) error {
+	limit := syscall.Rlimit{Cur: soft, Max: hard}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
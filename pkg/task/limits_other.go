@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package task
+
+// Limits of another process can only be set on linux.
+func set_rlimits(pid int, limits *ResourceLimits) error {
+	if limits.OpenFiles > 0 || limits.CpuSeconds > 0 || limits.AddressSpace > 0 {
+		return ErrLimitsNotSupported
+	}
+	return nil
+}
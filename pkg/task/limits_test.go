@@ -0,0 +1,91 @@
+package task
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLimits(t *testing.T) { TestingT(t) }
+
+type LimitsTests struct{}
+
+var _ = Suite(&LimitsTests{})
+
+func (suite *LimitsTests) TestValidate(c *C) {
+	c.Assert((&ResourceLimits{Nice: 19}).Validate(), Equals, nil)
+	c.Assert((&ResourceLimits{Nice: 20}).Validate(), Equals, ErrBadConfigLimits)
+	c.Assert((&ResourceLimits{Cgroup: &CgroupLimits{CpuMax: -1}}).Validate(), Equals, ErrBadConfigLimits)
+
+	_, err := (&Task{
+		Id:       "test-limits-validate",
+		Cmd:      &Cmd{Path: "echo", Limits: &ResourceLimits{Nice: -21}},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, ErrBadConfigLimits)
+}
+
+func (suite *LimitsTests) TestRlimits(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id: "test-limits-rlimits",
+		Cmd: &Cmd{
+			Path:   "bash",
+			Args:   []string{"-c", "ulimit -n; ulimit -t; nice"},
+			Limits: &ResourceLimits{OpenFiles: 64, CpuSeconds: 30, Nice: 5},
+		},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, "64\n30\n5\n")
+}
+
+func (suite *LimitsTests) TestCpuLimit(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id: "test-limits-cpu",
+		Cmd: &Cmd{
+			Path:   "bash",
+			Args:   []string{"-c", "while :; do :; done"},
+			Limits: &ResourceLimits{CpuSeconds: 1},
+		},
+	})
+	c.Assert(err, Equals, ErrLimitCpu)
+	c.Assert(runtime.Stats.Result.Error, Equals, ErrLimitCpu.Error())
+	c.Assert(runtime.State().Status, Equals, StatusError)
+}
+
+func (suite *LimitsTests) TestRunAs(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("requires root")
+	}
+	runtime, err := run_exec_only(c, Task{
+		Id: "test-limits-run-as",
+		Cmd: &Cmd{
+			Path:  "id",
+			Args:  []string{"-u"},
+			RunAs: &Credential{Uid: 65534, Gid: 65534},
+		},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, "65534\n")
+}
+
+func (suite *LimitsTests) TestCgroup(c *C) {
+	parent := c.MkDir()
+	dir, err := join_cgroup(1234, &CgroupLimits{Parent: parent, MemoryMax: 1 << 20, CpuMax: 0.5})
+	c.Assert(err, Equals, nil)
+	c.Assert(dir, Equals, filepath.Join(parent, "task-1234"))
+
+	read := func(file string) string {
+		buff, err := ioutil.ReadFile(filepath.Join(dir, file))
+		c.Assert(err, Equals, nil)
+		return string(buff)
+	}
+	c.Assert(read("memory.max"), Equals, "1048576")
+	c.Assert(read("cpu.max"), Equals, "50000 100000")
+	c.Assert(read("cgroup.procs"), Equals, "1234")
+
+	c.Assert(cgroup_oom_killed(dir), Equals, false)
+	c.Assert(write_cgroup(dir, "memory.events", "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), Equals, nil)
+	c.Assert(cgroup_oom_killed(dir), Equals, true)
+}
@@ -0,0 +1,121 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"runtime"
+	"text/template"
+	"time"
+)
+
+// Version of the LogEvent schema.  Bump this when making incompatible changes.
+const LogEventVersion = 1
+
+type Phase string
+
+const (
+	PhaseStart       Phase = "start"
+	PhaseTriggerWait Phase = "trigger-wait"
+	PhaseExec        Phase = "exec"
+	PhaseSuccess     Phase = "success"
+	PhaseError       Phase = "error"
+	PhaseStop        Phase = "stop"
+)
+
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+// Published as JSON on the task's LogTopic.
+type LogEvent struct {
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	TaskId    string    `json:"task_id"`
+	Name      TaskName  `json:"name,omitempty"`
+	Phase     Phase     `json:"phase"`
+	Level     Level     `json:"level"`
+	Message   string    `json:"message"`
+	Source    string    `json:"source,omitempty"`
+
+	// Human readable text from the log templates (e.g. log_template_start), if configured.
+	Text string `json:"text,omitempty"`
+}
+
+func (this *Runtime) set_phase(phase Phase) {
+	this.phase_lock.Lock()
+	defer this.phase_lock.Unlock()
+	this.phase = phase
+}
+
+func (this *Runtime) get_phase() Phase {
+	this.phase_lock.Lock()
+	defer this.phase_lock.Unlock()
+	return this.phase
+}
+
+// Changes the phase and logs the transition, with the rendered template if any.
+func (this *Runtime) log_phase(phase Phase, t *template.Template) {
+	this.set_phase(phase)
+	level := LevelInfo
+	if phase == PhaseError {
+		level = LevelError
+	}
+	this.publish_event(level, this.build_message(t), 2, string(phase))
+}
+
+// Logs at warning level.
+func (this *Runtime) Warn(m ...interface{}) {
+	this.publish_event(LevelWarn, "", 2, m...)
+}
+
+// depth is the number of stack frames to skip to find the source location.
+func (this *Runtime) publish_event(level Level, text string, depth int, m ...interface{}) {
+	switch {
+	case len(m) == 0:
+		return
+	case this.is_done():
+		return
+	}
+
+	message := this.mask(fmt.Sprint(m...))
+	source := ""
+	_, file, line, ok := runtime.Caller(depth)
+	if ok {
+		source = fmt.Sprintf("%s:%d", file, line)
+	}
+
+	event := LogEvent{
+		Version:   LogEventVersion,
+		Timestamp: time.Now(),
+		TaskId:    this.Task.Id,
+		Name:      this.Task.Name,
+		Phase:     this.get_phase(),
+		Level:     level,
+		Message:   message,
+		Source:    source,
+		Text:      this.mask(text),
+	}
+	// The log topic is published only once started and until stopped
+	if buff, err := json.Marshal(event); err != nil {
+		glog.Warningln("Cannot marshal log event:", err)
+	} else if this.is_started() {
+		select {
+		case this.status <- buff:
+		case <-this.stopped:
+		}
+	}
+
+	switch level {
+	case LevelWarn:
+		glog.Warningln(source, message)
+	case LevelError:
+		glog.Errorln(source, message)
+	default:
+		glog.Infoln(source, message)
+	}
+}
@@ -0,0 +1,76 @@
+package task
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) { TestingT(t) }
+
+type LogTests struct{}
+
+var _ = Suite(&LogTests{})
+
+func next_event(c *C, runtime *Runtime) LogEvent {
+	event := LogEvent{}
+	err := json.Unmarshal(<-runtime.status, &event)
+	c.Assert(err, Equals, nil)
+	return event
+}
+
+func (suite *LogTests) TestLogEvent(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-log",
+		Name:     "log-test",
+		Cmd:      &Cmd{Path: "echo"},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	runtime.started = 1 // events are read here instead of published
+
+	go func() { runtime.Log("hello", "world") }()
+	event := next_event(c, runtime)
+	c.Assert(event.Version, Equals, LogEventVersion)
+	c.Assert(event.TaskId, Equals, "test-log")
+	c.Assert(event.Name, Equals, TaskName("log-test"))
+	c.Assert(event.Level, Equals, LevelInfo)
+	c.Assert(event.Message, Equals, "helloworld")
+	c.Assert(event.Text, Equals, "")
+	c.Assert(strings.Contains(event.Source, "log_test.go"), Equals, true)
+	c.Assert(event.Timestamp.IsZero(), Equals, false)
+
+	go func() { runtime.Warn("careful") }()
+	event = next_event(c, runtime)
+	c.Assert(event.Level, Equals, LevelWarn)
+	c.Assert(strings.Contains(event.Source, "log_test.go"), Equals, true)
+}
+
+func (suite *LogTests) TestPhaseTemplates(c *C) {
+	start := "Starting {{.id}}"
+	runtime, err := (&Task{
+		Id:               "test-log-phase",
+		Cmd:              &Cmd{Path: "echo"},
+		LogTopic:         "mqtt://localhost:1883/test/log",
+		LogTemplateStart: &start,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	runtime.started = 1 // events are read here instead of published
+
+	go runtime.log_phase(PhaseStart, runtime.templateStart)
+	event := next_event(c, runtime)
+	c.Assert(event.Phase, Equals, PhaseStart)
+	c.Assert(event.Message, Equals, "start")
+	c.Assert(event.Text, Equals, "Starting test-log-phase")
+
+	go runtime.log_phase(PhaseError, runtime.templateError)
+	event = next_event(c, runtime)
+	c.Assert(event.Phase, Equals, PhaseError)
+	c.Assert(event.Level, Equals, LevelError)
+	c.Assert(event.Text, Equals, "")
+
+	go runtime.Log("after error")
+	event = next_event(c, runtime)
+	c.Assert(event.Phase, Equals, PhaseError)
+}
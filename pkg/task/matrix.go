@@ -0,0 +1,305 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/zk"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	DefaultMatrixItemName = "Item"
+
+	// Items' namespaces are <namespace>/matrix/<index>
+	matrix_dir = "matrix"
+)
+
+var (
+	ErrMatrixFailed = errors.New("matrix-failed")
+)
+
+type MatrixItem struct {
+	Index  int         `json:"index"`
+	Item   string      `json:"item"`
+	Status TaskStatus  `json:"status"`
+	Result *ExecResult `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Written to the success path if all items succeeded, otherwise to the error path.  Skipped
+// items were not started because of an earlier failure (fail-fast) or a stop.
+type MatrixResult struct {
+	Total     int          `json:"total"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Skipped   int          `json:"skipped"`
+	Items     []MatrixItem `json:"items"`
+}
+
+type MatrixRuntime struct {
+	Task
+
+	zk       zk.ZK
+	runtimes []*Runtime
+	items    []MatrixItem
+	lock     sync.Mutex
+	stopped  int32
+}
+
+func (this *Matrix) Validate() error {
+	switch {
+	case len(this.Values) == 0 && this.Children == nil:
+		return ErrBadConfigMatrix
+	case len(this.Values) > 0 && this.Children != nil:
+		return ErrBadConfigMatrix
+	case this.Concurrency < 0:
+		return ErrBadConfigMatrix
+	}
+	switch this.Policy {
+	case "", MatrixFailFast, MatrixContinue:
+	default:
+		return ErrBadConfigMatrix
+	}
+	return nil
+}
+
+func (this *Matrix) name() string {
+	if this.Name == "" {
+		return DefaultMatrixItemName
+	}
+	return this.Name
+}
+
+func (this *Matrix) fail_fast() bool {
+	return this.Policy != MatrixContinue
+}
+
+// Lists the items.  Children are sorted by name.
+func (this *Matrix) list(zkc zk.ZK) ([]string, error) {
+	if this.Children == nil {
+		return this.Values, nil
+	}
+	if zkc == nil {
+		return nil, ErrNoRegistry
+	}
+	n, err := zkc.Get(this.Children.Path())
+	if err != nil {
+		return nil, err
+	}
+	children, err := n.Children()
+	if err != nil {
+		return nil, err
+	}
+	items := []string{}
+	for _, c := range children {
+		items = append(items, c.GetBasename())
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// Expands the task into a runtime per item.  The item and its index are added to the env for
+// the substitutions in the command, paths and topics.  The namespace and topics of an item are
+// those of the task with the index appended, e.g. <log>/0.  Only the aggregate result is
+// written to the success and error paths.
+func (this *Task) InitMatrix(zkc zk.ZK, env map[string]interface{}, funcs map[string]interface{},
+	options ...interface{}) (*MatrixRuntime, error) {
+
+	if this.Matrix == nil {
+		return nil, ErrBadConfigMatrix
+	}
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+	items, err := this.Matrix.list(zkc)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := &MatrixRuntime{Task: *this, zk: zkc}
+	for i, item := range items {
+		ctx := map[string]interface{}{}
+		for k, v := range env {
+			ctx[k] = v
+		}
+		ctx[this.Matrix.name()] = item
+		ctx["Index"] = i
+
+		t, err := this.matrix_item(i, ctx)
+		if err != nil {
+			return nil, err
+		}
+		runtime, err := t.Init(zkc, options...)
+		if err != nil {
+			return nil, err
+		}
+		if err := runtime.ApplyEnvAndFuncs(ctx, funcs); err != nil {
+			return nil, err
+		}
+		matrix.runtimes = append(matrix.runtimes, runtime)
+		matrix.items = append(matrix.items, MatrixItem{Index: i, Item: item, Status: StatusPending})
+	}
+	return matrix, nil
+}
+
+func (this *Task) matrix_item(index int, ctx map[string]interface{}) (*Task, error) {
+	t, err := this.Copy()
+	if err != nil {
+		return nil, err
+	}
+	sub := fmt.Sprintf("%d", index)
+	t.Id = this.Id + "." + sub
+	t.Matrix = nil
+	t.Success = nil
+	t.Error = nil
+	if t.Namespace != nil {
+		ns := t.Namespace.Sub(matrix_dir, sub)
+		t.Namespace = &ns
+	}
+	if len(t.LogTopic) > 0 {
+		t.LogTopic = t.LogTopic.Sub(sub)
+	}
+	for _, topic := range []*pubsub.Topic{t.Stdout, t.Stderr, t.Control} {
+		if topic != nil {
+			*topic = topic.Sub(sub)
+		}
+	}
+	if err := t.apply_context(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (this *MatrixRuntime) SetDecrypter(decrypter Decrypter) {
+	for _, runtime := range this.runtimes {
+		runtime.SetDecrypter(decrypter)
+	}
+}
+
+// Returns the runtime of the item at the index.
+func (this *MatrixRuntime) Item(index int) *Runtime {
+	return this.runtimes[index]
+}
+
+// Runs the items up to the concurrency limit.  The returned channel receives nil if all items
+// succeeded or ErrMatrixFailed, once all started items have exited.
+func (this *MatrixRuntime) Start() (chan error, error) {
+	concurrency := this.Matrix.Concurrency
+	if concurrency == 0 || concurrency > len(this.runtimes) {
+		concurrency = len(this.runtimes)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		slots := make(chan bool, concurrency)
+		var wg sync.WaitGroup
+		for i, runtime := range this.runtimes {
+			slots <- true
+			if atomic.LoadInt32(&this.stopped) == 1 {
+				<-slots
+				continue
+			}
+			wg.Add(1)
+			go func(i int, runtime *Runtime) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				this.set_item(i, StatusRunning, nil)
+				err := run_item(runtime)
+				// Once the item is no longer running, Stop does not cancel it.
+				this.set_item(i, status_for(err), err)
+				runtime.Stop()
+				if err != nil && this.Matrix.fail_fast() {
+					this.Stop()
+				}
+			}(i, runtime)
+		}
+		wg.Wait()
+		done <- this.report()
+	}()
+	return done, nil
+}
+
+// Cancels the running items and does not start any more.
+func (this *MatrixRuntime) Stop() {
+	atomic.StoreInt32(&this.stopped, 1)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for i, item := range this.items {
+		if item.Status == StatusRunning {
+			this.runtimes[i].Cancel(syscall.SIGTERM)
+		}
+	}
+}
+
+func run_item(runtime *Runtime) error {
+	done, err := runtime.Start()
+	if err != nil {
+		return err
+	}
+	if done != nil {
+		err = <-done
+	}
+	return err
+}
+
+func (this *MatrixRuntime) set_item(index int, status TaskStatus, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := &this.items[index]
+	item.Status = status
+	item.Result = this.runtimes[index].Stats.Result
+	if err != nil {
+		item.Error = err.Error()
+	}
+}
+
+func (this *MatrixRuntime) Result() MatrixResult {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	result := MatrixResult{
+		Total: len(this.items),
+		Items: make([]MatrixItem, len(this.items)),
+	}
+	copy(result.Items, this.items)
+	for _, item := range this.items {
+		switch item.Status {
+		case StatusSuccess:
+			result.Succeeded++
+		case StatusPending:
+			result.Skipped++
+		default:
+			result.Failed++
+		}
+	}
+	return result
+}
+
+// Writes the aggregate result to the success or error path.
+func (this *MatrixRuntime) report() error {
+	result := this.Result()
+	var err error
+	path := this.Task.Success
+	if result.Succeeded < result.Total {
+		err = ErrMatrixFailed
+		path = this.Task.Error
+	}
+	glog.Infoln("Matrix", this.Id, "total=", result.Total, "succeeded=", result.Succeeded,
+		"failed=", result.Failed, "skipped=", result.Skipped)
+
+	if this.zk == nil || path == nil {
+		return err
+	}
+	if e := zk.CreateOrSet(this.zk, *path, result); e != nil {
+		glog.Warningln("Matrix", this.Id, "cannot write result to", *path, "Err=", e)
+	}
+	return err
+}
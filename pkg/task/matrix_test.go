@@ -0,0 +1,89 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestMatrix(t *testing.T) { TestingT(t) }
+
+type MatrixTests struct{}
+
+var _ = Suite(&MatrixTests{})
+
+func (suite *MatrixTests) TestValidate(c *C) {
+	children := registry.Path("/regions")
+	c.Assert((&Matrix{Values: []string{"a"}}).Validate(), Equals, nil)
+	c.Assert((&Matrix{Children: &children}).Validate(), Equals, nil)
+	c.Assert((&Matrix{}).Validate(), Equals, ErrBadConfigMatrix)
+	c.Assert((&Matrix{Values: []string{"a"}, Children: &children}).Validate(), Equals, ErrBadConfigMatrix)
+	c.Assert((&Matrix{Values: []string{"a"}, Policy: "sometimes"}).Validate(), Equals, ErrBadConfigMatrix)
+
+	_, err := (&Task{Id: "test-matrix-children", Cmd: &Cmd{Path: "echo"}, ExecOnly: true,
+		Matrix: &Matrix{Children: &children}}).InitMatrix(nil, nil, nil)
+	c.Assert(err, Equals, ErrNoRegistry)
+}
+
+func (suite *MatrixTests) TestExpand(c *C) {
+	namespace := registry.Path("/unit-test/matrix")
+	matrix, err := (&Task{
+		Id:        "test-matrix",
+		Cmd:       &Cmd{Path: "echo", Args: []string{"{{.Env}}", "{{.Region}}", "{{.Index}}"}},
+		Namespace: &namespace,
+		ExecOnly:  true,
+		Matrix:    &Matrix{Name: "Region", Values: []string{"us-east", "eu-west"}},
+	}).InitMatrix(nil, map[string]interface{}{"Env": "prod"}, nil)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(matrix.Item(0).Id, Equals, "test-matrix.0")
+	c.Assert(matrix.Item(0).Cmd.Args, DeepEquals, []string{"prod", "us-east", "0"})
+	c.Assert(matrix.Item(1).Cmd.Args, DeepEquals, []string{"prod", "eu-west", "1"})
+	c.Assert(*matrix.Item(1).Namespace, Equals, registry.Path("/unit-test/matrix/matrix/1"))
+	c.Assert(matrix.Item(1).Matrix, IsNil)
+}
+
+func run_matrix(c *C, values []string, policy MatrixPolicy, concurrency int) (MatrixResult, error) {
+	matrix, err := (&Task{
+		Id:       "test-matrix-run",
+		Cmd:      &Cmd{Path: "bash", Args: []string{"-c", "sleep 0.2; test {{.Item}} != fail"}},
+		ExecOnly: true,
+		Matrix:   &Matrix{Values: values, Policy: policy, Concurrency: concurrency},
+	}).InitMatrix(nil, nil, nil)
+	c.Assert(err, Equals, nil)
+	done, err := matrix.Start()
+	c.Assert(err, Equals, nil)
+	err = <-done
+	return matrix.Result(), err
+}
+
+func (suite *MatrixTests) TestSuccess(c *C) {
+	start := time.Now()
+	result, err := run_matrix(c, []string{"a", "b", "c", "d"}, MatrixFailFast, 2)
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Total, Equals, 4)
+	c.Assert(result.Succeeded, Equals, 4)
+	c.Assert(result.Items[3].Result.ExitCode, Equals, 0)
+
+	// Two at a time
+	c.Assert(time.Since(start) >= 400*time.Millisecond, Equals, true)
+}
+
+func (suite *MatrixTests) TestContinueOnError(c *C) {
+	result, err := run_matrix(c, []string{"a", "fail", "c"}, MatrixContinue, 1)
+	c.Assert(err, Equals, ErrMatrixFailed)
+	c.Assert(result.Succeeded, Equals, 2)
+	c.Assert(result.Failed, Equals, 1)
+	c.Assert(result.Items[1].Status, Equals, StatusError)
+	c.Assert(result.Items[1].Result.ExitCode, Equals, 1)
+}
+
+func (suite *MatrixTests) TestFailFast(c *C) {
+	result, err := run_matrix(c, []string{"a", "fail", "c", "d"}, MatrixFailFast, 1)
+	c.Assert(err, Equals, ErrMatrixFailed)
+	c.Assert(result.Succeeded, Equals, 1)
+	c.Assert(result.Failed, Equals, 1)
+	c.Assert(result.Skipped, Equals, 2)
+	c.Assert(result.Items[2].Status, Equals, StatusPending)
+}
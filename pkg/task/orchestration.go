@@ -0,0 +1,418 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadOrchestration   = errors.New("bad-orchestration")
+	ErrUnknownTask        = errors.New("unknown-task")
+	ErrCircularDependency = errors.New("circular-dependency")
+)
+
+type TaskStatus string
+
+const (
+	StatusPending   TaskStatus = "pending"
+	StatusWaiting   TaskStatus = "waiting"
+	StatusRunning   TaskStatus = "running"
+	StatusSuccess   TaskStatus = "success"
+	StatusError     TaskStatus = "error"
+	StatusCancelled TaskStatus = "cancelled"
+	StatusTimedOut  TaskStatus = "timed-out"
+)
+
+// Published to the orchestration's log topic on each change of state.
+type OrchestrationStatus struct {
+	Id        string                  `json:"id"`
+	Name      string                  `json:"name,omitempty"`
+	Status    TaskStatus              `json:"status"`
+	Tasks     map[TaskName]TaskStatus `json:"tasks"`
+	Error     string                  `json:"error,omitempty"`
+	Timestamp int64                   `json:"timestamp"`
+}
+
+type OrchestrationRuntime struct {
+	Orchestration
+
+	zk       zk.ZK
+	options  interface{}
+	context  map[string]interface{}
+	runtimes map[TaskName]*Runtime
+	status   map[TaskName]TaskStatus
+	lock     sync.Mutex
+}
+
+type task_result struct {
+	name  TaskName
+	error error
+}
+
+func LoadOrchestration(r io.Reader) (*Orchestration, error) {
+	o := new(Orchestration)
+	if err := json.NewDecoder(r).Decode(o); err != nil {
+		return nil, err
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Checks the structure of the orchestration.  Paths and topics are checked only after
+// they are templated, when the orchestration is initialized.
+func (this *Orchestration) Validate() error {
+	if len(this.Tasks) == 0 {
+		return ErrBadOrchestration
+	}
+	for _, t := range this.Tasks {
+		if t.After == nil {
+			continue
+		}
+		if _, has := this.Tasks[*t.After]; !has {
+			return ErrUnknownTask
+		}
+	}
+	// Following the After chain from any task should terminate within len(tasks) steps.
+	for name := range this.Tasks {
+		steps := 0
+		for next := this.Tasks[name].After; next != nil; next = this.Tasks[*next].After {
+			if steps++; steps > len(this.Tasks) {
+				return ErrCircularDependency
+			}
+		}
+	}
+	return nil
+}
+
+// Initializes the orchestration with the given context.  The context is used to template
+// the paths and topics of each task and the task commands.  If not set, the Id in the context
+// defaults to the orchestration id.
+func (this *Orchestration) Init(zkc zk.ZK, context map[string]interface{}, options ...interface{}) (*OrchestrationRuntime, error) {
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx := map[string]interface{}{}
+	for k, v := range context {
+		ctx[k] = v
+	}
+	if _, has := ctx["Id"]; !has {
+		ctx["Id"] = this.Id
+	}
+
+	o := OrchestrationRuntime{
+		Orchestration: *this,
+		zk:            zkc,
+		context:       ctx,
+		runtimes:      map[TaskName]*Runtime{},
+		status:        map[TaskName]TaskStatus{},
+	}
+	if len(options) > 0 {
+		o.options = options[0]
+	}
+
+	if log, err := apply(string(this.Log), ctx, nil); err != nil {
+		return nil, err
+	} else {
+		o.Log = pubsub.Topic(log)
+	}
+	if len(o.Log) > 0 && !o.Log.Valid() {
+		return nil, ErrBadConfigStatus
+	}
+
+	tasks, err := o.build_tasks()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, t := range tasks {
+		runtime, err := t.Init(zkc, options...)
+		if err != nil {
+			glog.Warningln("Cannot initialize task", name, "Err=", err)
+			return nil, err
+		}
+		if err := runtime.ApplyEnvAndFuncs(ctx, nil); err != nil {
+			return nil, err
+		}
+		o.runtimes[name] = runtime
+		o.status[name] = StatusPending
+	}
+	return &o, nil
+}
+
+// Makes a copy of each task with the paths templated and the triggers wired.
+func (this *OrchestrationRuntime) build_tasks() (map[TaskName]*Task, error) {
+	tasks := map[TaskName]*Task{}
+	for name, t := range this.Tasks {
+		copy, err := t.Copy()
+		if err != nil {
+			return nil, err
+		}
+		if len(copy.Name) == 0 {
+			copy.Name = name
+		}
+		if len(copy.Id) == 0 {
+			copy.Id = this.Id + "." + string(name)
+		}
+		if len(copy.LogTopic) == 0 && len(this.Log) > 0 {
+			copy.LogTopic = this.Log.Sub(string(name))
+		}
+		if err := copy.apply_context(this.context); err != nil {
+			return nil, err
+		}
+		tasks[name] = copy
+	}
+
+	for _, t := range tasks {
+		if t.After == nil {
+			continue
+		}
+		prev := tasks[*t.After]
+		if prev.Success == nil {
+			if !this.Context.Valid() {
+				glog.Warningln("Task", prev.Name, "has no success path and no context to default to.")
+				return nil, ErrBadConfigSuccess
+			}
+			p, err := apply_path(this.Context.Sub(string(prev.Name), "success"), this.context)
+			if err != nil {
+				return nil, err
+			}
+			prev.Success = &p
+		}
+
+		if t.Trigger == nil {
+			t.Trigger = new(Trigger)
+		}
+		if t.Trigger.Registry == nil {
+			t.Trigger.Registry = new(registry.Conditions)
+		}
+		// The predecessor's success is required in addition to any other conditions.
+		start := registry.Create(*prev.Success)
+		after := registry.Condition{Create: &start}
+		if expr := t.Trigger.Registry.Expr; expr != nil {
+			after = registry.Condition{And: []registry.Condition{after, *expr}}
+		}
+		t.Trigger.Registry.Expr = &after
+	}
+	return tasks, nil
+}
+
+func (this *Task) apply_context(ctx map[string]interface{}) error {
+	var err error
+	if this.Id, err = apply(this.Id, ctx, nil); err != nil {
+		return err
+	}
+	for _, p := range []*registry.Path{this.Namespace, this.Success, this.Error} {
+		if p == nil {
+			continue
+		}
+		if *p, err = apply_path(*p, ctx); err != nil {
+			return err
+		}
+	}
+	topics := []*pubsub.Topic{&this.LogTopic, this.Stdin, this.Stdout, this.Stderr, this.Control}
+	if this.Trigger != nil && this.Trigger.PubSub != nil {
+		topics = append(topics, &this.Trigger.PubSub.Topic)
+	}
+	for _, t := range topics {
+		if t == nil {
+			continue
+		}
+		if s, err := apply(string(*t), ctx, nil); err != nil {
+			return err
+		} else {
+			*t = pubsub.Topic(s)
+		}
+	}
+	if this.Outputs != nil {
+		if this.Outputs, err = this.Outputs.apply_context(ctx); err != nil {
+			return err
+		}
+	}
+	if this.Trigger != nil && this.Trigger.Registry != nil {
+		c := this.Trigger.Registry
+		leaves := []*registry.Condition{{Create: c.Create, Delete: c.Delete, Change: c.Change, Members: c.Members}}
+		if c.Expr != nil {
+			leaves = append(leaves, c.Expr.Leaves()...)
+		}
+		for _, leaf := range leaves {
+			if err := apply_condition(leaf, ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the context to the paths of the leaf conditions.
+func apply_condition(c *registry.Condition, ctx map[string]interface{}) error {
+	if c.Create != nil {
+		p, err := apply_path(registry.Path(*c.Create), ctx)
+		if err != nil {
+			return err
+		}
+		*c.Create = registry.Create(p)
+	}
+	if c.Delete != nil {
+		p, err := apply_path(registry.Path(*c.Delete), ctx)
+		if err != nil {
+			return err
+		}
+		*c.Delete = registry.Delete(p)
+	}
+	if c.Change != nil {
+		p, err := apply_path(registry.Path(*c.Change), ctx)
+		if err != nil {
+			return err
+		}
+		*c.Change = registry.Change(p)
+	}
+	if c.Members != nil {
+		var err error
+		if c.Members.Top, err = apply_path(c.Members.Top, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apply_path(p registry.Path, ctx map[string]interface{}) (registry.Path, error) {
+	s, err := apply(string(p), ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	return registry.Path(s), nil
+}
+
+// Returns the runtime of the named task.
+func (this *OrchestrationRuntime) Task(name TaskName) *Runtime {
+	return this.runtimes[name]
+}
+
+// Starts all the tasks.  Tasks block on their triggers until their predecessors succeed.
+// The returned channel receives a single value:  nil if all tasks succeeded or the first error.
+func (this *OrchestrationRuntime) Start() (chan error, error) {
+	now := time.Now()
+	this.StartTime = &now
+
+	// Buffered so the tasks still running after the first error do not block
+	results := make(chan task_result, len(this.runtimes))
+	for name, runtime := range this.runtimes {
+		go func(name TaskName, runtime *Runtime) {
+			this.set_status(name, StatusWaiting)
+			done, err := runtime.Start()
+			switch {
+			case err != nil:
+				results <- task_result{name, err}
+				return
+			case done == nil:
+				results <- task_result{name, nil}
+				return
+			}
+			this.set_status(name, StatusRunning)
+			results <- task_result{name, <-done}
+		}(name, runtime)
+	}
+
+	this.publish("")
+
+	orchestration_done := make(chan error, 1)
+	go func() {
+		for i := 0; i < len(this.runtimes); i++ {
+			r := <-results
+			if r.error != nil {
+				glog.Warningln("Task", r.name, "failed. Err=", r.error)
+				this.set_status(r.name, StatusError)
+				this.publish(r.error.Error())
+				this.Stop()
+				orchestration_done <- r.error
+				return
+			}
+			this.set_status(r.name, StatusSuccess)
+			this.publish("")
+		}
+		orchestration_done <- nil
+	}()
+	return orchestration_done, nil
+}
+
+// Stops the tasks that have been started.
+func (this *OrchestrationRuntime) Stop() {
+	this.lock.Lock()
+	started := []*Runtime{}
+	for name, runtime := range this.runtimes {
+		if this.status[name] != StatusPending {
+			started = append(started, runtime)
+		}
+	}
+	this.lock.Unlock()
+
+	for _, runtime := range started {
+		runtime.Stop()
+	}
+}
+
+func (this *OrchestrationRuntime) set_status(name TaskName, status TaskStatus) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.status[name] = status
+}
+
+// The overall status is error if any task failed, success if all tasks succeeded,
+// running if any task is running and waiting otherwise.
+func (this *OrchestrationRuntime) Status() OrchestrationStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	status := OrchestrationStatus{
+		Id:        this.Id,
+		Name:      this.Name,
+		Tasks:     map[TaskName]TaskStatus{},
+		Timestamp: time.Now().Unix(),
+	}
+	count := map[TaskStatus]int{}
+	for name, s := range this.status {
+		status.Tasks[name] = s
+		count[s]++
+	}
+	switch {
+	case count[StatusError] > 0:
+		status.Status = StatusError
+	case count[StatusSuccess] == len(this.status):
+		status.Status = StatusSuccess
+	case count[StatusRunning] > 0:
+		status.Status = StatusRunning
+	case count[StatusPending] == len(this.status):
+		status.Status = StatusPending
+	default:
+		status.Status = StatusWaiting
+	}
+	return status
+}
+
+func (this *OrchestrationRuntime) publish(error string) {
+	status := this.Status()
+	status.Error = error
+
+	if len(this.Log) == 0 {
+		glog.Infoln("Orchestration", this.Id, "status=", status.Status)
+		return
+	}
+	c, err := this.Log.Broker().PubSub(this.Id, this.options)
+	if err != nil {
+		glog.Warningln("Cannot publish:", this.Log.String(), "Err=", err)
+		return
+	}
+	if m, err := json.Marshal(status); err == nil {
+		c.Publish(this.Log, m)
+	}
+}
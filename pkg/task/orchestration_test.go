@@ -0,0 +1,170 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrchestration(t *testing.T) { TestingT(t) }
+
+type OrchestrationTests struct{}
+
+var _ = Suite(&OrchestrationTests{})
+
+func (suite *OrchestrationTests) TestLoadExample(c *C) {
+	f, err := os.Open("../../examples/workflow.json")
+	c.Assert(err, Equals, nil)
+	defer f.Close()
+
+	o, err := LoadOrchestration(f)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(o.Tasks), Equals, 4)
+	c.Assert(*o.Tasks["db-seed"].After, Equals, TaskName("db-migrate"))
+	c.Assert(o.Tasks["db-migrate"].After, Equals, (*TaskName)(nil))
+
+	runtime := &OrchestrationRuntime{
+		Orchestration: *o,
+		context: map[string]interface{}{
+			"Domain":  "test.com",
+			"Id":      "1234",
+			"Version": "v1",
+		},
+	}
+	tasks, err := runtime.build_tasks()
+	c.Assert(err, Equals, nil)
+
+	migrate := tasks["db-migrate"]
+	c.Assert(*migrate.Namespace, Equals, registry.Path("/test.com/deployment/1234/db-migrate"))
+	c.Assert(*migrate.Success, Equals, registry.Path("/test.com/deployment/1234/db-seed"))
+	c.Assert(migrate.Trigger.Registry.Members.Top, Equals, registry.Path("/test.com/passport-db-master/containers"))
+	c.Assert(migrate.Trigger.Registry.Create, Equals, (*registry.Create)(nil))
+	c.Assert(time.Duration(*migrate.Trigger.Registry.Timeout), Equals, 300*time.Second)
+
+	// Wired to the predecessor's success path, in addition to the members condition
+	seed := tasks["db-seed"]
+	c.Assert(seed.Trigger.Registry.Create, Equals, (*registry.Create)(nil))
+	c.Assert(seed.Trigger.Registry.All, Equals, false)
+	c.Assert(seed.Trigger.Registry.Tree().String(), Equals,
+		"members(/test.com/passport-db-master/containers) >= 1 && create(/test.com/deployment/1234/db-seed)")
+
+	// No trigger of its own
+	run := tasks["run-containers"]
+	c.Assert(run.Trigger.Registry.Tree().String(), Equals, "create(/test.com/deployment/1234/run-containers)")
+
+	reload := tasks["proxy-reload"]
+	c.Assert(reload.Trigger.Registry.Members.Top, Equals, registry.Path("/test.com/passport/v1/containers"))
+	c.Assert(reload.LogTopic.String(), Equals, "mqtt://iot.eclipse.org:1883/test.com/deployment/1234/proxy-reload")
+
+	// The originals are not modified
+	c.Assert(*o.Tasks["db-migrate"].Namespace, Equals, registry.Path("/{{.Domain}}/deployment/{{.Id}}/db-migrate"))
+	c.Assert(o.Tasks["run-containers"].Trigger, Equals, (*Trigger)(nil))
+}
+
+func (suite *OrchestrationTests) TestDefaultSuccessPath(c *C) {
+	first := TaskName("first")
+	o, err := LoadOrchestration(strings.NewReader(`{
+		"id" : "abc",
+		"context" : "/{{.Domain}}/orchestration/{{.Id}}",
+		"tasks" : {
+			"first" : {},
+			"second" : { "after" : "first" }
+		}
+	}`))
+	c.Assert(err, Equals, nil)
+	c.Assert(*o.Tasks["second"].After, Equals, first)
+
+	runtime := &OrchestrationRuntime{
+		Orchestration: *o,
+		context:       map[string]interface{}{"Domain": "test.com", "Id": "abc"},
+	}
+	tasks, err := runtime.build_tasks()
+	c.Assert(err, Equals, nil)
+	c.Assert(*tasks["first"].Success, Equals, registry.Path("/test.com/orchestration/abc/first/success"))
+	c.Assert(*tasks["second"].Trigger.Registry.Expr.Create, Equals, registry.Create("/test.com/orchestration/abc/first/success"))
+	c.Assert(tasks["second"].Id, Equals, "abc.second")
+}
+
+func (suite *OrchestrationTests) TestValidate(c *C) {
+	_, err := LoadOrchestration(strings.NewReader(`{ "tasks" : {} }`))
+	c.Assert(err, Equals, ErrBadOrchestration)
+
+	_, err = LoadOrchestration(strings.NewReader(`{ "tasks" : { "a" : { "after" : "b" } } }`))
+	c.Assert(err, Equals, ErrUnknownTask)
+
+	_, err = LoadOrchestration(strings.NewReader(`{ "tasks" : {
+		"a" : { "after" : "c" },
+		"b" : { "after" : "a" },
+		"c" : { "after" : "b" }
+	} }`))
+	c.Assert(err, Equals, ErrCircularDependency)
+}
+
+func (suite *OrchestrationTests) TestAfterKeepsConditions(c *C) {
+	o, err := LoadOrchestration(strings.NewReader(`{
+		"id" : "abc",
+		"tasks" : {
+			"first" : { "success" : "/{{.Id}}/first" },
+			"second" : {
+				"after" : "first",
+				"control" : "kfka://local:1/{{.Id}}/control",
+				"trigger" : {
+					"registry" : {
+						"create" : "/{{.Id}}/go",
+						"delete" : "/{{.Id}}/hold",
+						"expr" : "!create(/{{.Id}}/maintenance)"
+					}
+				}
+			},
+			"third" : {
+				"trigger" : { "pubsub" : { "topic" : "kfka://local:1/{{.Id}}/deploy" } }
+			}
+		}
+	}`))
+	c.Assert(err, Equals, nil)
+
+	runtime := &OrchestrationRuntime{Orchestration: *o, context: map[string]interface{}{"Id": "abc"}}
+	tasks, err := runtime.build_tasks()
+	c.Assert(err, Equals, nil)
+
+	// Either of the conditions of its own, and the predecessor's success
+	second := tasks["second"].Trigger.Registry
+	c.Assert(second.All, Equals, false)
+	c.Assert(second.Tree().String(), Equals,
+		"(create(/abc/go) || delete(/abc/hold)) && (create(/abc/first) && !create(/abc/maintenance))")
+
+	c.Assert(*tasks["second"].Control, Equals, pubsub.Topic("kfka://local:1/abc/control"))
+	c.Assert(tasks["third"].Trigger.PubSub.Topic, Equals, pubsub.Topic("kfka://local:1/abc/deploy"))
+}
+
+func (suite *OrchestrationTests) TestNoCmd(c *C) {
+	runtime, err := (&Task{Id: "test-no-cmd", LogTopic: "kfka://local:1/test-no-cmd"}).Init(nil)
+	c.Assert(err, Equals, nil)
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(done, IsNil)
+	c.Assert(runtime.Stats.Success > 0, Equals, false) // not recorded without zk
+	runtime.Stop()
+}
+
+func (suite *OrchestrationTests) TestStopBeforeStart(c *C) {
+	runtime, err := (&Task{Id: "test-stop-first", Cmd: &Cmd{Path: "echo"}, LogTopic: "kfka://local:1/test-stop-first"}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	stopped := make(chan bool)
+	go func() {
+		runtime.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		c.Fatal("Stop blocked")
+	}
+	_, err = runtime.Start()
+	c.Assert(err, Equals, ErrStopped)
+}
@@ -0,0 +1,139 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/zk"
+	"strings"
+)
+
+// Parses stdout into a flat map of field to value.  For json, nested objects are flattened
+// with dots, e.g. {"db":{"host":"x"}} gives db.host.  Key=value lines are split at the first
+// '='; blank lines and lines starting with # are skipped.
+func (this *Outputs) parse(stdout []byte) (map[string]interface{}, error) {
+	parsed := map[string]interface{}{}
+	switch this.format() {
+	case OutputJSON:
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(bytes.TrimSpace(stdout), &doc); err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrBadOutput, err)
+		}
+		flatten("", doc, parsed)
+	case OutputKeyValue:
+		scanner := bufio.NewScanner(bytes.NewReader(stdout))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			i := strings.Index(line, "=")
+			if i < 1 {
+				continue
+			}
+			parsed[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrBadOutput, err)
+		}
+	}
+	return parsed, nil
+}
+
+func flatten(prefix string, doc map[string]interface{}, flat map[string]interface{}) {
+	for k, v := range doc {
+		key := k
+		if len(prefix) > 0 {
+			key = prefix + "." + k
+		}
+		flat[key] = v
+		if m, ok := v.(map[string]interface{}); ok {
+			flatten(key, m, flat)
+		}
+	}
+}
+
+// Returns the values of the declared outputs.  Fails if a required output is missing.
+func (this *Outputs) extract(stdout []byte) (map[string]interface{}, error) {
+	parsed, err := this.parse(stdout)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	for _, o := range this.Values {
+		v, has := parsed[o.Field]
+		if !has || v == nil {
+			if o.Required {
+				return nil, fmt.Errorf("%s: %s", ErrMissingOutput, o.Field)
+			}
+			continue
+		}
+		values[o.Field] = v
+	}
+	return values, nil
+}
+
+func (this *Outputs) format() OutputFormat {
+	if this.Format == "" {
+		return OutputJSON
+	}
+	return this.Format
+}
+
+func (this *Outputs) Validate() error {
+	switch this.format() {
+	case OutputJSON, OutputKeyValue:
+	default:
+		return ErrBadConfigOutputs
+	}
+	for _, o := range this.Values {
+		switch {
+		case len(o.Field) == 0:
+			return ErrBadConfigOutputs
+		case !o.Path.Valid():
+			return ErrBadConfigOutputs
+		}
+	}
+	return nil
+}
+
+// Returns a copy with the paths templated with the context.
+func (this *Outputs) apply_context(ctx map[string]interface{}) (*Outputs, error) {
+	applied := &Outputs{Format: this.Format, Values: make([]Output, len(this.Values))}
+	for i, o := range this.Values {
+		p, err := apply_path(o.Path, ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.Path = p
+		applied.Values[i] = o
+	}
+	return applied, nil
+}
+
+// Writes each output value to its path.  Strings are written as is and everything else as json.
+func (this *Runtime) write_outputs(values map[string]interface{}) error {
+	if this.zk == nil {
+		glog.Infoln("Not connected to zk.  Outputs not recorded")
+		return nil
+	}
+	for _, o := range this.Outputs.Values {
+		v, has := values[o.Field]
+		if !has {
+			continue
+		}
+		var err error
+		if s, ok := v.(string); ok {
+			err = zk.CreateOrSetString(this.zk, o.Path, s)
+		} else {
+			err = zk.CreateOrSet(this.zk, o.Path, v)
+		}
+		if err != nil {
+			return err
+		}
+		this.Log("Output", o.Field, "written to", o.Path.Path())
+	}
+	return nil
+}
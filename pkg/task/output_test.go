@@ -0,0 +1,86 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+)
+
+func TestOutput(t *testing.T) { TestingT(t) }
+
+type OutputTests struct{}
+
+var _ = Suite(&OutputTests{})
+
+func (suite *OutputTests) TestParseJSON(c *C) {
+	outputs := &Outputs{
+		Values: []Output{
+			{Field: "host", Path: "/out/host", Required: true},
+			{Field: "db.port", Path: "/out/port"},
+			{Field: "missing", Path: "/out/missing"},
+		},
+	}
+	values, err := outputs.extract([]byte(`{"host":"10.0.0.1", "db":{"port":5432}}`))
+	c.Assert(err, Equals, nil)
+	c.Assert(values["host"], Equals, "10.0.0.1")
+	c.Assert(values["db.port"], Equals, float64(5432))
+	_, has := values["missing"]
+	c.Assert(has, Equals, false)
+
+	_, err = outputs.extract([]byte("not json"))
+	c.Assert(strings.Index(err.Error(), ErrBadOutput.Error()), Equals, 0)
+}
+
+func (suite *OutputTests) TestParseKeyValue(c *C) {
+	outputs := &Outputs{
+		Format: OutputKeyValue,
+		Values: []Output{
+			{Field: "HOST", Path: "/out/host", Required: true},
+			{Field: "URL", Path: "/out/url"},
+		},
+	}
+	values, err := outputs.extract([]byte("# comment\nHOST = 10.0.0.1\n\nURL=http://x/?a=b\n"))
+	c.Assert(err, Equals, nil)
+	c.Assert(values["HOST"], Equals, "10.0.0.1")
+	c.Assert(values["URL"], Equals, "http://x/?a=b")
+
+	_, err = outputs.extract([]byte("URL=http://x\n"))
+	c.Assert(err.Error(), Equals, ErrMissingOutput.Error()+": HOST")
+}
+
+func (suite *OutputTests) TestValidate(c *C) {
+	c.Assert((&Outputs{Values: []Output{{Field: "a", Path: "/a"}}}).Validate(), Equals, nil)
+	c.Assert((&Outputs{Format: "xml"}).Validate(), Equals, ErrBadConfigOutputs)
+	c.Assert((&Outputs{Values: []Output{{Field: "a"}}}).Validate(), Equals, ErrBadConfigOutputs)
+	c.Assert((&Outputs{Values: []Output{{Path: "/a"}}}).Validate(), Equals, ErrBadConfigOutputs)
+}
+
+func (suite *OutputTests) TestApplyContext(c *C) {
+	outputs := &Outputs{Values: []Output{{Field: "host", Path: "/{{.Domain}}/host"}}}
+	applied, err := outputs.apply_context(map[string]interface{}{"Domain": "test.com"})
+	c.Assert(err, Equals, nil)
+	c.Assert(applied.Values[0].Path, Equals, registry.Path("/test.com/host"))
+	c.Assert(outputs.Values[0].Path, Equals, registry.Path("/{{.Domain}}/host")) // not modified
+}
+
+func (suite *OutputTests) TestRequiredOutputFailsTask(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:      "test-output-required",
+		Cmd:     &Cmd{Path: "echo", Args: []string{`{"a":1}`}},
+		Outputs: &Outputs{Values: []Output{{Field: "b", Path: "/b", Required: true}}},
+	})
+	c.Assert(err, Not(Equals), nil)
+	c.Assert(runtime.Stats.Result.Error, Equals, ErrMissingOutput.Error()+": b")
+	c.Assert(runtime.Stats.Attempts, Equals, 1)
+}
+
+func (suite *OutputTests) TestOutputsInResult(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:      "test-output-result",
+		Cmd:     &Cmd{Path: "echo", Args: []string{`{"a":"x"}`}},
+		Outputs: &Outputs{Values: []Output{{Field: "a", Path: "/a", Required: true}}},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.Stats.Result.Outputs["a"], Equals, "x")
+}
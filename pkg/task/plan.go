@@ -0,0 +1,274 @@
+package task
+
+import (
+	"fmt"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"io"
+	"strings"
+	"time"
+)
+
+// Current state of a trigger condition in the registry.  Met is true if the condition would
+// be satisfied by the current state, e.g. the node of a create condition exists in level mode.
+// Change and delta conditions need an actual change so they are never met, and a condition
+// under a stable_for is pending until it has held.
+type PlanCondition struct {
+	Type     string        `json:"type"`
+	Path     registry.Path `json:"path"`
+	Exists   bool          `json:"exists"`
+	Value    string        `json:"value,omitempty"`
+	Children int32         `json:"children,omitempty"`
+	Met      bool          `json:"met"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// What a task would do if started.
+type Plan struct {
+	Id   string   `json:"id"`
+	Name TaskName `json:"name,omitempty"`
+	Cmd  *Cmd     `json:"cmd,omitempty"`
+
+	Log     pubsub.Topic  `json:"log,omitempty"`
+	Stdin   *pubsub.Topic `json:"stdin,omitempty"`
+	Stdout  *pubsub.Topic `json:"stdout,omitempty"`
+	Stderr  *pubsub.Topic `json:"stderr,omitempty"`
+	Control *pubsub.Topic `json:"control,omitempty"`
+
+	Cron      *CronExpression `json:"cron,omitempty"`
+	NextRun   *time.Time      `json:"next_run,omitempty"`
+	Order     TriggerOrder    `json:"order,omitempty"`
+	All       bool            `json:"all,omitempty"`
+	Level     bool            `json:"level,omitempty"`
+	Trigger   []PlanCondition `json:"trigger,omitempty"`
+	Triggered bool            `json:"triggered"`
+	// Expression of all the registry conditions
+	Expr string `json:"expr,omitempty"`
+	// Runs on messages from the topic
+	PubSub *PubSubTrigger `json:"pubsub,omitempty"`
+
+	// Registry paths the task would write to
+	Writes []registry.Path `json:"writes,omitempty"`
+	// Files rendered before the command runs
+	Files []File `json:"files,omitempty"`
+}
+
+// Validates the task and returns what it would do with the given env and funcs applied,
+// without starting any process.  If zkc is nil, the trigger conditions are not evaluated.
+func (this *Task) Plan(zkc zk.ZK, env map[string]interface{}, funcs map[string]interface{}) (*Plan, error) {
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+	copy, err := this.Copy()
+	if err != nil {
+		return nil, err
+	}
+	runtime := &Runtime{Task: *copy, zk: zkc}
+	runtime.set_defaults()
+	if env != nil || funcs != nil {
+		if err := runtime.ApplyEnvAndFuncs(env, funcs); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &Plan{
+		Id:        runtime.Id,
+		Name:      runtime.Name,
+		Cmd:       runtime.Cmd,
+		Log:       runtime.LogTopic,
+		Stdin:     runtime.Task.Stdin,
+		Stdout:    runtime.Task.Stdout,
+		Stderr:    runtime.Task.Stderr,
+		Control:   runtime.Task.Control,
+		Files:     runtime.Files,
+		Triggered: true,
+	}
+
+	if t := runtime.Trigger; t != nil {
+		plan.Order = t.ordering()
+		if t.Cron != nil {
+			plan.Cron = t.Cron
+			if cron, err := t.Cron.Parse(); err == nil {
+				if next := cron.Next(time.Now()); !next.IsZero() {
+					plan.NextRun = &next
+				}
+			}
+		}
+		plan.PubSub = t.PubSub
+		if t.Registry != nil {
+			plan.All = t.Registry.All
+			plan.Level = t.Registry.Level
+			if tree := t.Registry.Tree(); tree != nil {
+				plan.Expr = tree.String()
+				plan.Trigger, plan.Triggered = plan_conditions(zkc, tree, t.Registry.Level)
+			}
+		}
+	}
+
+	for _, p := range []*registry.Path{runtime.Task.Success, runtime.Task.Error} {
+		if p != nil {
+			plan.Writes = append(plan.Writes, *p)
+		}
+	}
+	if runtime.Outputs != nil {
+		for _, o := range runtime.Outputs.Values {
+			plan.Writes = append(plan.Writes, o.Path)
+		}
+	}
+	if runtime.Namespace != nil {
+		plan.Writes = append(plan.Writes, runtime.Namespace.Sub("exit"),
+			runtime.Namespace.Sub(state_node), runtime.Namespace.Sub(runs_dir),
+			runtime.Namespace.Sub(cancel_node))
+		if runtime.Retry != nil {
+			plan.Writes = append(plan.Writes, runtime.Namespace.Sub("attempts"))
+		}
+		if runtime.Service != nil {
+			plan.Writes = append(plan.Writes, runtime.Namespace.Sub(live_node))
+		}
+		if runtime.Workers == WorkersExclusive {
+			plan.Writes = append(plan.Writes, runtime.Namespace.Sub(exclusive_dir))
+		}
+		if runtime.Heartbeat != nil {
+			plan.Writes = append(plan.Writes, runtime.Namespace.Sub(heartbeat_node),
+				runtime.Namespace.Sub(progress_key))
+		}
+	}
+	return plan, nil
+}
+
+// Returns the state of each leaf and whether the tree is met with the leaves as they are.
+// Only in level mode is a leaf met by the current state: a node exists or not, a change with
+// a value predicate holds if the current value satisfies it, and a node that does not exist
+// has no members.  Otherwise the watch waits for an event.  Negated leaves are always in
+// level mode.  A leaf under a stable_for is pending until it has held, so it is not met.
+func plan_conditions(zkc zk.ZK, tree *registry.Condition, level bool) ([]PlanCondition, bool) {
+	conditions := []PlanCondition{}
+	met := map[*registry.Condition]bool{}
+	negated := map[*registry.Condition]bool{}
+	for _, c := range tree.Negated() {
+		negated[c] = true
+	}
+	stable := map[*registry.Condition]bool{}
+	for _, c := range tree.Stable() {
+		stable[c] = true
+	}
+	for _, c := range tree.Leaves() {
+		level := level || negated[c]
+		var p PlanCondition
+		switch {
+		case c.Create != nil:
+			p = plan_condition(zkc, "create", registry.Path(*c.Create),
+				func(p *PlanCondition) bool { return level && p.Exists })
+		case c.Delete != nil:
+			p = plan_condition(zkc, "delete", registry.Path(*c.Delete),
+				func(p *PlanCondition) bool { return level && !p.Exists })
+		case c.Change != nil:
+			v := c.Value
+			p = plan_condition(zkc, "change", registry.Path(*c.Change),
+				func(p *PlanCondition) bool {
+					return level && v != nil && v.Op != registry.OpChanged && p.Exists &&
+						v.Met(nil, []byte(p.Value))
+				})
+		case c.Members != nil:
+			m := *c.Members
+			p = plan_condition(zkc, "members", m.Top,
+				func(p *PlanCondition) bool {
+					return level && m.Delta == nil && zk.MembersMet(m, p.Children, p.Children)
+				})
+		}
+		if stable[c] {
+			p.Met = false
+		}
+		met[c] = p.Met
+		conditions = append(conditions, p)
+	}
+	return conditions, tree.Eval(func(c *registry.Condition) bool { return met[c] },
+		func(c *registry.Condition, v bool) bool { return false })
+}
+
+func plan_condition(zkc zk.ZK, t string, path registry.Path, met func(*PlanCondition) bool) PlanCondition {
+	c := PlanCondition{Type: t, Path: path}
+	if zkc == nil {
+		c.Error = ErrNoRegistry.Error()
+		return c
+	}
+	n, err := zkc.Get(path.Path())
+	switch {
+	case err == zk.ErrNotExist:
+	case err != nil:
+		c.Error = err.Error()
+		return c
+	default:
+		c.Exists = true
+		c.Value = n.GetValueString()
+		if n.Stats != nil {
+			c.Children = n.Stats.NumChildren
+		}
+	}
+	c.Met = met(&c)
+	return c
+}
+
+// Prints the plan in a human readable form.
+func (this *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Task:     %s %s\n", this.Id, this.Name)
+	if this.Cmd != nil {
+		fmt.Fprintf(w, "Cmd:      %s %s\n", this.Cmd.Path, strings.Join(this.Cmd.Args, " "))
+		if len(this.Cmd.Dir) > 0 {
+			fmt.Fprintf(w, "Dir:      %s\n", this.Cmd.Dir)
+		}
+		for _, e := range this.Cmd.Env {
+			fmt.Fprintf(w, "Env:      %s\n", e)
+		}
+	}
+	fmt.Fprintf(w, "Log:      %s\n", this.Log)
+	for _, t := range []struct {
+		label string
+		topic *pubsub.Topic
+	}{
+		{"Stdin:    ", this.Stdin},
+		{"Stdout:   ", this.Stdout},
+		{"Stderr:   ", this.Stderr},
+		{"Control:  ", this.Control},
+	} {
+		if t.topic != nil {
+			fmt.Fprintf(w, "%s%s\n", t.label, *t.topic)
+		}
+	}
+	if this.Cron != nil {
+		fmt.Fprintf(w, "Cron:     %s (%s)\n", *this.Cron, this.Order)
+		if this.NextRun != nil {
+			fmt.Fprintf(w, "Next run: %s\n", this.NextRun.Format(time.RFC3339))
+		}
+	}
+	if this.PubSub != nil {
+		fmt.Fprintf(w, "PubSub:   %s match=%v regex=%q once=%v\n", this.PubSub.Topic, this.PubSub.Match,
+			this.PubSub.Regex, this.PubSub.Once)
+	}
+	for _, c := range this.Trigger {
+		state := "absent"
+		switch {
+		case len(c.Error) > 0:
+			state = "error: " + c.Error
+		case c.Type == "members":
+			state = fmt.Sprintf("%d children", c.Children)
+		case c.Exists:
+			state = fmt.Sprintf("exists value=%q", c.Value)
+		}
+		fmt.Fprintf(w, "Trigger:  %s %s [%s] met=%v\n", c.Type, c.Path, state, c.Met)
+	}
+	if len(this.Trigger) > 0 {
+		mode := ""
+		if this.Level {
+			mode = ", level"
+		}
+		fmt.Fprintf(w, "Triggered: %v (%s%s)\n", this.Triggered, this.Expr, mode)
+	}
+	for _, p := range this.Writes {
+		fmt.Fprintf(w, "Writes:   %s\n", p)
+	}
+	for _, f := range this.Files {
+		fmt.Fprintf(w, "File:     %s <- %s\n", f.Path, f.Template)
+	}
+}
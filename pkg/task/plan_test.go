@@ -0,0 +1,174 @@
+package task
+
+import (
+	"bytes"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) { TestingT(t) }
+
+type PlanTests struct{}
+
+var _ = Suite(&PlanTests{})
+
+// Registry of nodes in memory that answers Get and Delete.  The tests do not use the other calls.
+type fake_zk struct {
+	zk.ZK
+	nodes map[string]*zk.Node
+}
+
+func (this *fake_zk) Get(path string) (*zk.Node, error) {
+	n, has := this.nodes[path]
+	if !has {
+		return nil, zk.ErrNotExist
+	}
+	return n, nil
+}
+
+func (this *fake_zk) Delete(path string) error {
+	if _, has := this.nodes[path]; !has {
+		return zk.ErrNotExist
+	}
+	delete(this.nodes, path)
+	return nil
+}
+
+func (suite *PlanTests) TestPlan(c *C) {
+	namespace := registry.Path("/unit-test/plan")
+	success := registry.Path("/unit-test/plan/success")
+	create := registry.Create("/unit-test/plan/ready")
+	cron := CronExpression("@hourly")
+	task := &Task{
+		Id:        "test-plan",
+		Name:      "plan",
+		Namespace: &namespace,
+		LogTopic:  pubsub.Topic("mqtt://localhost:1883/unit-test/plan"),
+		Cmd:       &Cmd{Path: "echo", Args: []string{"{{.Message}}"}},
+		Success:   &success,
+		Trigger: &Trigger{
+			Cron:     &cron,
+			Registry: &registry.Conditions{Create: &create},
+		},
+		Outputs: &Outputs{Values: []Output{{Field: "host", Path: "/unit-test/plan/host"}}},
+	}
+
+	plan, err := task.Plan(nil, map[string]interface{}{"Message": "hello"}, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(plan.Cmd.Args, DeepEquals, []string{"hello"})
+	c.Assert(task.Cmd.Args, DeepEquals, []string{"{{.Message}}"}) // not modified
+	c.Assert(*plan.Stdout, Equals, pubsub.Topic("mqtt://localhost:1883/unit-test/plan/stdout"))
+	c.Assert(*plan.Stderr, Equals, pubsub.Topic("mqtt://localhost:1883/unit-test/plan/stderr"))
+	c.Assert(*plan.Control, Equals, pubsub.Topic("mqtt://localhost:1883/unit-test/plan/control"))
+	c.Assert(plan.NextRun, Not(Equals), nil)
+	c.Assert(plan.Order, Equals, CronGatedByRegistry)
+	c.Assert(plan.Writes, DeepEquals, []registry.Path{
+		"/unit-test/plan/success",
+		"/unit-test/plan/host",
+		"/unit-test/plan/exit",
+		"/unit-test/plan/status",
+		"/unit-test/plan/runs",
+		"/unit-test/plan/cancel",
+	})
+
+	// Without zk, conditions are not evaluated
+	c.Assert(len(plan.Trigger), Equals, 1)
+	c.Assert(plan.Trigger[0].Error, Equals, ErrNoRegistry.Error())
+	c.Assert(plan.Triggered, Equals, false)
+
+	var buff bytes.Buffer
+	plan.Print(&buff)
+	c.Assert(strings.Contains(buff.String(), "Cmd:      echo hello\n"), Equals, true)
+	c.Assert(strings.Contains(buff.String(), "Trigger:  create /unit-test/plan/ready"), Equals, true)
+	c.Assert(strings.Contains(buff.String(), "Writes:   /unit-test/plan/success\n"), Equals, true)
+}
+
+func (suite *PlanTests) TestPlanInvalid(c *C) {
+	_, err := (&Task{Id: "test-plan-invalid", ExecOnly: true}).Plan(nil, nil, nil)
+	c.Assert(err, Equals, ErrBadConfig)
+}
+
+func (suite *PlanTests) TestPlanExpr(c *C) {
+	create := registry.Create("/unit-test/{{.Env}}/ready")
+	expr, err := registry.ParseCondition("members(/unit-test/{{.Env}}/db) >= 1 && !create(/unit-test/maintenance)")
+	c.Assert(err, Equals, nil)
+	task := &Task{
+		Id:       "test-plan-expr",
+		Cmd:      &Cmd{Path: "echo"},
+		LogTopic: pubsub.Topic("mqtt://localhost:1883/unit-test/plan"),
+		Trigger: &Trigger{
+			Registry: &registry.Conditions{Create: &create, Expr: expr},
+		},
+	}
+	c.Assert(task.apply_context(map[string]interface{}{"Env": "prod"}), Equals, nil)
+
+	plan, err := task.Plan(nil, nil, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(plan.Expr, Equals,
+		"create(/unit-test/prod/ready) && (members(/unit-test/prod/db) >= 1 && !create(/unit-test/maintenance))")
+	c.Assert(len(plan.Trigger), Equals, 3)
+	c.Assert(plan.Trigger[1].Type, Equals, "members")
+
+	// The not of an unevaluated create holds but the and does not
+	c.Assert(plan.Triggered, Equals, false)
+
+	bad, err := registry.ParseCondition("create(/a)")
+	c.Assert(err, Equals, nil)
+	bad.Delete = new(registry.Delete)
+	task.Trigger.Registry.Expr = bad
+	_, err = task.Plan(nil, nil, nil)
+	c.Assert(err, Equals, ErrBadConfigTrigger)
+}
+
+func (suite *PlanTests) TestPlanLevel(c *C) {
+	create := registry.Create("/unit-test/plan-level/ready")
+	task := &Task{
+		Id:       "test-plan-level",
+		Cmd:      &Cmd{Path: "echo"},
+		LogTopic: pubsub.Topic("mqtt://localhost:1883/unit-test/plan"),
+		Trigger: &Trigger{
+			Registry: &registry.Conditions{Create: &create, Level: true},
+		},
+	}
+	plan, err := task.Plan(nil, nil, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(plan.Level, Equals, true)
+
+	var buff bytes.Buffer
+	plan.Print(&buff)
+	c.Assert(strings.Contains(buff.String(), "Triggered: false (create(/unit-test/plan-level/ready), level)\n"), Equals, true)
+}
+
+func (suite *PlanTests) TestPlanConditions(c *C) {
+	zkc := &fake_zk{nodes: map[string]*zk.Node{"/a": {Path: "/a", Value: []byte("1")}}}
+	tree, err := registry.ParseCondition("create(/a) && !create(/b)")
+	c.Assert(err, Equals, nil)
+
+	// A create is an event unless in level mode, so an existing node does not meet it
+	conditions, met := plan_conditions(zkc, tree, false)
+	c.Assert(conditions[0].Exists, Equals, true)
+	c.Assert(conditions[0].Met, Equals, false)
+	c.Assert(met, Equals, false)
+
+	conditions, met = plan_conditions(zkc, tree, true)
+	c.Assert(conditions[0].Met, Equals, true)
+	c.Assert(met, Equals, true)
+
+	// Pending until the condition has held
+	tree, err = registry.ParseCondition("create(/a) for 1s")
+	c.Assert(err, Equals, nil)
+	conditions, met = plan_conditions(zkc, tree, true)
+	c.Assert(conditions[0].Met, Equals, false)
+	c.Assert(met, Equals, false)
+
+	tree, err = registry.ParseCondition("create(/a) && !create(/b) for 1s")
+	c.Assert(err, Equals, nil)
+	conditions, met = plan_conditions(zkc, tree, true)
+	c.Assert(conditions[0].Met, Equals, true)
+	c.Assert(conditions[1].Met, Equals, false)
+	c.Assert(met, Equals, false)
+}
@@ -0,0 +1,173 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Keys of the triggering message in the env for the command substitutions
+	MessageKey = "Message"
+	PayloadKey = "Payload"
+)
+
+func (this *PubSubTrigger) Validate() error {
+	if !this.Topic.Valid() {
+		return ErrBadConfigTrigger
+	}
+	if _, err := this.compiled(); err != nil {
+		return ErrBadConfigTrigger
+	}
+	return nil
+}
+
+// Compiles the regex the first time.  Nil if there is no regex.
+func (this *PubSubTrigger) compiled() (*regexp.Regexp, error) {
+	if this.regex == nil && this.Regex != "" {
+		regex, err := regexp.Compile(this.Regex)
+		if err != nil {
+			return nil, err
+		}
+		this.regex = regex
+	}
+	return this.regex, nil
+}
+
+// True if the message passes the regex and the field matches.  A message that is not a JSON
+// object never matches any fields.  Nothing matches a bad regex.
+func (this *PubSubTrigger) matches(m []byte) bool {
+	if this.Regex != "" {
+		regex, err := this.compiled()
+		if err != nil || !regex.Match(m) {
+			return false
+		}
+	}
+	if len(this.Match) == 0 {
+		return true
+	}
+	payload, ok := parse_payload(m).(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for field, expect := range this.Match {
+		v, has := lookup_field(payload, field)
+		if !has || fmt.Sprint(v) != expect {
+			return false
+		}
+	}
+	return true
+}
+
+func parse_payload(m []byte) interface{} {
+	var payload interface{}
+	if err := json.Unmarshal(m, &payload); err != nil {
+		return nil
+	}
+	return payload
+}
+
+func lookup_field(payload map[string]interface{}, field string) (interface{}, bool) {
+	var v interface{} = payload
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Runs the task for each matching message on the topic.  The returned channel receives the
+// result of each run and is closed when the runtime is stopped or cancelled, or when the
+// subscription ends.  Messages are handled one at a time.  A task that runs once stops
+// listening after its run and the channel is closed.
+func (this *Runtime) start_pubsub() (chan error, error) {
+	trigger := this.Trigger.PubSub
+	c, err := trigger.Topic.Broker().PubSub(this.Id, this.options)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.Subscribe(trigger.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Substitutions are applied again for each message
+	cmd := this.unapplied
+	if cmd == nil {
+		cmd = this.Cmd
+	}
+
+	results := make(chan error)
+	go func() {
+		defer close(results)
+		for {
+			this.set_phase(PhaseTriggerWait)
+			this.set_state(StatusWaiting, nil)
+			this.Log("Waiting for message on", trigger.Topic.String())
+
+			var m []byte
+			select {
+			case message, open := <-messages:
+				if !open {
+					this.Warn("Subscription closed:", trigger.Topic.String())
+					return
+				}
+				m = message
+			case <-this.cancelling:
+				this.Log("Cancelled.  Stopping subscription:", trigger.Topic.String())
+				return
+			case <-this.stopped:
+				return
+			}
+			if !trigger.matches(m) {
+				continue
+			}
+			this.Stats.Triggered = this.Now()
+
+			result := this.exec_message(cmd, m)
+			select {
+			case results <- result:
+			case <-this.stopped:
+				return
+			}
+
+			if trigger.Once {
+				return
+			}
+			if this.is_cancelled() {
+				this.Log("Cancelled.  Stopping subscription:", trigger.Topic.String())
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+func (this *Runtime) exec_message(cmd *Cmd, m []byte) error {
+	ctx := map[string]interface{}{}
+	for k, v := range this.context {
+		ctx[k] = v
+	}
+	ctx[MessageKey] = string(m)
+	ctx[PayloadKey] = parse_payload(m)
+
+	applied, err := cmd.ApplySubstitutions(ctx, this.funcs)
+	if err != nil {
+		this.Error(err.Error())
+		return err
+	}
+	this.Cmd = applied
+	this.payload = m
+
+	done, err := this.exec()
+	if err != nil {
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,156 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/pubsub"
+	. "gopkg.in/check.v1"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPubSubTrigger(t *testing.T) { TestingT(t) }
+
+type PubSubTriggerTests struct{}
+
+var _ = Suite(&PubSubTriggerTests{})
+
+// In-process pubsub for the tests.  There is no kafka client, so it takes the kfka protocol.
+type local_pubsub struct {
+	lock        sync.Mutex
+	subscribers map[pubsub.Topic][]chan []byte
+}
+
+var local = &local_pubsub{subscribers: map[pubsub.Topic][]chan []byte{}}
+
+func init() {
+	pubsub.Register("kfka", func(id, addr string, options ...interface{}) (pubsub.PubSub, error) {
+		return local, nil
+	})
+}
+
+func (this *local_pubsub) Publish(topic pubsub.Topic, message []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, sub := range this.subscribers[topic] {
+		// Subscribers of stopped runtimes are no longer read
+		select {
+		case sub <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+func (this *local_pubsub) Subscribe(topic pubsub.Topic) (<-chan []byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	sub := make(chan []byte, 10)
+	this.subscribers[topic] = append(this.subscribers[topic], sub)
+	return sub, nil
+}
+
+func (this *local_pubsub) Close() {}
+
+// Ends the subscriptions to the topic, as a broker does when the connection is lost.
+func (this *local_pubsub) unsubscribe(topic pubsub.Topic) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, sub := range this.subscribers[topic] {
+		close(sub)
+	}
+	delete(this.subscribers, topic)
+}
+
+func (suite *PubSubTriggerTests) TestValidate(c *C) {
+	cron := CronExpression("* * * * *")
+	c.Assert((&PubSubTrigger{Topic: "kfka://local:1/t"}).Validate(), Equals, nil)
+	c.Assert((&PubSubTrigger{Topic: "t"}).Validate(), Equals, ErrBadConfigTrigger)
+	c.Assert((&PubSubTrigger{Topic: "kfka://local:1/t", Regex: "("}).Validate(), Equals, ErrBadConfigTrigger)
+	c.Assert((&Trigger{Cron: &cron, PubSub: &PubSubTrigger{Topic: "kfka://local:1/t"}}).Validate(), Equals, ErrBadConfigTrigger)
+
+	stdin := pubsub.Topic("kfka://local:1/stdin")
+	err := (&Task{Id: "test-pubsub", Cmd: &Cmd{Path: "cat"}, ExecOnly: true, Stdin: &stdin,
+		Trigger: &Trigger{PubSub: &PubSubTrigger{Topic: "kfka://local:1/t"}}}).Validate()
+	c.Assert(err, Equals, ErrBadConfigTrigger)
+}
+
+func (suite *PubSubTriggerTests) TestMatches(c *C) {
+	trigger := &PubSubTrigger{Match: map[string]string{"build.branch": "master", "ok": "true"}}
+	c.Assert(trigger.matches([]byte(`{"build":{"branch":"master"},"ok":true}`)), Equals, true)
+	c.Assert(trigger.matches([]byte(`{"build":{"branch":"dev"},"ok":true}`)), Equals, false)
+	c.Assert(trigger.matches([]byte(`{"build":"master","ok":true}`)), Equals, false)
+	c.Assert(trigger.matches([]byte(`master`)), Equals, false)
+
+	trigger = &PubSubTrigger{Regex: "^deploy "}
+	c.Assert(trigger.matches([]byte(`deploy v1`)), Equals, true)
+	c.Assert(trigger.matches([]byte(`rollback v1`)), Equals, false)
+}
+
+func start_pubsub_task(c *C, topic pubsub.Topic, trigger *PubSubTrigger) (*Runtime, chan error) {
+	trigger.Topic = topic
+	runtime, err := (&Task{
+		Id: "test-pubsub-trigger",
+		Cmd: &Cmd{
+			Path: "bash",
+			Args: []string{"-c", "echo {{.Env}} {{.Payload.version}} $(cat)"},
+		},
+		ExecOnly: true,
+		Trigger:  &Trigger{PubSub: trigger},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.ApplyEnvAndFuncs(map[string]interface{}{"Env": "prod"}, nil), Equals, nil)
+	runtime.CaptureStdout()
+
+	results, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	// Wait for the subscription
+	for runtime.State().Status != StatusWaiting {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime, results
+}
+
+func (suite *PubSubTriggerTests) TestRunPerMessage(c *C) {
+	topic := pubsub.Topic("kfka://local:1/unit-test/pubsub/each")
+	runtime, results := start_pubsub_task(c, topic, &PubSubTrigger{Match: map[string]string{"env": "prod"}})
+
+	local.Publish(topic, []byte(`{"env":"dev","version":"1"}`))
+	local.Publish(topic, []byte(`{"env":"prod","version":"2"}`))
+	c.Assert(<-results, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, `prod 2 {"env":"prod","version":"2"}`+"\n")
+
+	local.Publish(topic, []byte(`{"env":"prod","version":"3"}`))
+	c.Assert(<-results, Equals, nil)
+	c.Assert(runtime.Stats.Result.Output, Equals, `prod 3 {"env":"prod","version":"3"}`+"\n")
+	c.Assert(runtime.Runs, Equals, 2)
+
+	runtime.Stop()
+	_, open := <-results
+	c.Assert(open, Equals, false)
+}
+
+func (suite *PubSubTriggerTests) TestOnce(c *C) {
+	topic := pubsub.Topic("kfka://local:1/unit-test/pubsub/once")
+	runtime, results := start_pubsub_task(c, topic, &PubSubTrigger{Once: true})
+
+	local.Publish(topic, []byte(`{"version":"1"}`))
+	c.Assert(<-results, Equals, nil)
+	_, open := <-results
+	c.Assert(open, Equals, false)
+
+	local.Publish(topic, []byte(`{"version":"2"}`))
+	time.Sleep(200 * time.Millisecond)
+	c.Assert(runtime.Runs, Equals, 1)
+	runtime.Stop()
+}
+
+func (suite *PubSubTriggerTests) TestSubscriptionClosed(c *C) {
+	topic := pubsub.Topic("kfka://local:1/unit-test/pubsub/closed")
+	runtime, results := start_pubsub_task(c, topic, &PubSubTrigger{})
+
+	local.unsubscribe(topic)
+	_, open := <-results
+	c.Assert(open, Equals, false)
+	c.Assert(runtime.Runs, Equals, 0)
+	runtime.Stop()
+}
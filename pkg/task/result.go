@@ -0,0 +1,60 @@
+package task
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Outcome and resource usage of a process.  This is the payload written to the success
+// or error path and is included in the task stats of the exit announcement.
+type ExecResult struct {
+	Pid      int    `json:"pid,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+
+	WallTimeMs   int64 `json:"wall_time_ms"`
+	UserTimeMs   int64 `json:"user_time_ms"`
+	SystemTimeMs int64 `json:"system_time_ms"`
+	MaxRSSKb     int64 `json:"max_rss_kb"`
+
+	// Captured stdout on success
+	Output string `json:"output,omitempty"`
+	// Values extracted from stdout
+	Outputs map[string]interface{} `json:"outputs,omitempty"`
+	// Reason for failure
+	Error string `json:"error,omitempty"`
+}
+
+// Builds the result from the process state.  Exit code is -1 if the process did not exit
+// normally, e.g. it was killed by a signal.
+func new_exec_result(ps *os.ProcessState, wall time.Duration) *ExecResult {
+	result := &ExecResult{
+		ExitCode:   -1,
+		WallTimeMs: int64(wall / time.Millisecond),
+	}
+	if ps == nil {
+		return result
+	}
+
+	result.Pid = ps.Pid()
+	result.UserTimeMs = int64(ps.UserTime() / time.Millisecond)
+	result.SystemTimeMs = int64(ps.SystemTime() / time.Millisecond)
+
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+		switch {
+		case ws.Exited():
+			result.ExitCode = ws.ExitStatus()
+		case ws.Signaled():
+			result.Signal = ws.Signal().String()
+		}
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok && ru != nil {
+		result.MaxRSSKb = int64(ru.Maxrss)
+		if runtime.GOOS == "darwin" {
+			result.MaxRSSKb /= 1024 // darwin reports bytes
+		}
+	}
+	return result
+}
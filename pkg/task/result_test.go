@@ -0,0 +1,65 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestResult(t *testing.T) { TestingT(t) }
+
+type ResultTests struct{}
+
+var _ = Suite(&ResultTests{})
+
+func run_exec_only(c *C, t Task) (*Runtime, error) {
+	t.ExecOnly = true
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+	runtime.CaptureStdout()
+
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	return runtime, <-done
+}
+
+func (suite *ResultTests) TestSuccess(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-result-success",
+		Cmd: &Cmd{Path: "echo", Args: []string{"hello"}},
+	})
+	c.Assert(err, Equals, nil)
+
+	result := runtime.Stats.Result
+	c.Assert(result, Not(Equals), (*ExecResult)(nil))
+	c.Assert(result.ExitCode, Equals, 0)
+	c.Assert(result.Signal, Equals, "")
+	c.Assert(result.Pid > 0, Equals, true)
+	c.Assert(result.Output, Equals, "hello\n")
+	c.Assert(result.MaxRSSKb > 0, Equals, true)
+}
+
+func (suite *ResultTests) TestExitCode(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-result-exit-code",
+		Cmd: &Cmd{Path: "bash", Args: []string{"-c", "exit 7"}},
+	})
+	c.Assert(err, Not(Equals), nil)
+	c.Assert(runtime.Stats.Result.ExitCode, Equals, 7)
+	c.Assert(runtime.Stats.Result.Error, Equals, err.Error())
+}
+
+func (suite *ResultTests) TestSignal(c *C) {
+	timeout := registry.Timeout(100 * time.Millisecond)
+	runtime, err := run_exec_only(c, Task{
+		Id:          "test-result-signal",
+		Cmd:         &Cmd{Path: "sleep", Args: []string{"10"}},
+		ExecTimeout: &timeout,
+	})
+	c.Assert(err, Equals, ErrExecTimeout)
+	c.Assert(runtime.Stats.Result.ExitCode, Equals, -1)
+	c.Assert(runtime.Stats.Result.Signal, Equals, "terminated")
+	c.Assert(runtime.Stats.Result.Error, Equals, ErrExecTimeout.Error())
+	c.Assert(runtime.Stats.Result.WallTimeMs >= 100, Equals, true)
+}
@@ -0,0 +1,107 @@
+package task
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultRetryDelay = 1 * time.Second
+)
+
+// Announced under the task namespace at attempts/<n> after each attempt of a run.
+type Attempt struct {
+	Run      int    `json:"run"`
+	Attempt  int    `json:"attempt"`
+	Started  int64  `json:"started"`
+	Exited   int64  `json:"exited"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Returns true if another attempt should be made after the given (1-based) attempt failed.
+// Timeouts are not retried.  If no exit codes are listed, any non-zero exit code is retryable.
+func (this *RetryPolicy) retryable(attempt, code int, err error) bool {
+	switch {
+	case this == nil:
+		return false
+	case attempt >= this.MaxAttempts:
+		return false
+	case err == ErrExecTimeout, err == ErrCancelled:
+		return false
+	case len(this.ExitCodes) == 0:
+		return code != 0
+	}
+	for _, c := range this.ExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay before the next attempt after the given (1-based) attempt.
+func (this *RetryPolicy) delay(attempt int) time.Duration {
+	d := DefaultRetryDelay
+	if this.Delay != nil {
+		d = time.Duration(*this.Delay)
+	}
+	if this.Backoff == BackoffExponential {
+		d = clamp_delay(float64(d) * math.Pow(2, float64(attempt-1)))
+	}
+	if this.MaxDelay != nil && d > time.Duration(*this.MaxDelay) {
+		d = time.Duration(*this.MaxDelay)
+	}
+	if this.Jitter > 0 {
+		// +/- Jitter fraction of the delay
+		d = clamp_delay(float64(d) + (rand.Float64()*2-1)*this.Jitter*float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Converts to a duration, keeping values too large for one at the longest duration.
+func clamp_delay(f float64) time.Duration {
+	if f >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(f)
+}
+
+func (this *RetryPolicy) Validate() error {
+	switch {
+	case this.MaxAttempts < 1:
+		return ErrBadConfigRetry
+	case this.Jitter < 0 || this.Jitter > 1:
+		return ErrBadConfigRetry
+	}
+	switch this.Backoff {
+	case "", BackoffFixed, BackoffExponential:
+	default:
+		return ErrBadConfigRetry
+	}
+	return nil
+}
+
+func (this *Runtime) record_attempt(attempt int, started int64, result *ExecResult, err error) {
+	this.Stats.Attempts = attempt
+
+	a := Attempt{
+		Run:      this.Runs,
+		Attempt:  attempt,
+		Started:  started,
+		Exited:   this.Now(),
+		ExitCode: result.ExitCode,
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	this.Announce() <- Announce{
+		Key:   fmt.Sprintf("attempts/%d", attempt),
+		Value: a,
+	}
+}
@@ -0,0 +1,150 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) { TestingT(t) }
+
+type RetryTests struct{}
+
+var _ = Suite(&RetryTests{})
+
+func (suite *RetryTests) TestRetryable(c *C) {
+	var none *RetryPolicy
+	c.Assert(none.retryable(1, 1, ErrExecFailed), Equals, false)
+
+	p := &RetryPolicy{MaxAttempts: 3}
+	c.Assert(p.retryable(1, 1, ErrExecFailed), Equals, true)
+	c.Assert(p.retryable(2, 1, ErrExecFailed), Equals, true)
+	c.Assert(p.retryable(3, 1, ErrExecFailed), Equals, false)
+	c.Assert(p.retryable(1, -1, ErrExecTimeout), Equals, false)
+
+	p = &RetryPolicy{MaxAttempts: 3, ExitCodes: []int{75}}
+	c.Assert(p.retryable(1, 75, ErrExecFailed), Equals, true)
+	c.Assert(p.retryable(1, 1, ErrExecFailed), Equals, false)
+}
+
+func (suite *RetryTests) TestDelay(c *C) {
+	delay := registry.Timeout(100 * time.Millisecond)
+	max := registry.Timeout(300 * time.Millisecond)
+
+	p := &RetryPolicy{MaxAttempts: 5, Delay: &delay}
+	c.Assert(p.delay(1), Equals, 100*time.Millisecond)
+	c.Assert(p.delay(4), Equals, 100*time.Millisecond)
+
+	p = &RetryPolicy{MaxAttempts: 5, Delay: &delay, Backoff: BackoffExponential, MaxDelay: &max}
+	c.Assert(p.delay(1), Equals, 100*time.Millisecond)
+	c.Assert(p.delay(2), Equals, 200*time.Millisecond)
+	c.Assert(p.delay(3), Equals, 300*time.Millisecond)
+	c.Assert(p.delay(10), Equals, 300*time.Millisecond)
+
+	p = &RetryPolicy{MaxAttempts: 5, Delay: &delay, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		c.Assert(d >= 50*time.Millisecond && d <= 150*time.Millisecond, Equals, true)
+	}
+	// Without a max, the backoff stops at the longest duration
+	p = &RetryPolicy{MaxAttempts: 100, Delay: &delay, Backoff: BackoffExponential, Jitter: 0.5}
+	c.Assert(p.delay(100) > 0, Equals, true)
+	p.Jitter = 0
+	c.Assert(p.delay(100), Equals, time.Duration(math.MaxInt64))
+}
+
+func (suite *RetryTests) TestStopBetweenRetries(c *C) {
+	delay := registry.Timeout(10 * time.Second)
+	runtime, err := (&Task{
+		Id:       "test-retry-stop",
+		Cmd:      &Cmd{Path: "bash", Args: []string{"-c", "exit 1"}},
+		ExecOnly: true,
+		Retry:    &RetryPolicy{MaxAttempts: 3, Delay: &delay},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+
+	time.Sleep(200 * time.Millisecond)
+	go runtime.Stop()
+
+	c.Assert(<-done, Not(Equals), nil)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	c.Assert(runtime.Stats.Attempts, Equals, 1)
+	c.Assert(runtime.Stats.Result.ExitCode, Equals, 1)
+}
+
+func (suite *RetryTests) TestValidate(c *C) {
+	c.Assert((&RetryPolicy{MaxAttempts: 2}).Validate(), Equals, nil)
+	c.Assert((&RetryPolicy{}).Validate(), Equals, ErrBadConfigRetry)
+	c.Assert((&RetryPolicy{MaxAttempts: 2, Jitter: 2}).Validate(), Equals, ErrBadConfigRetry)
+	c.Assert((&RetryPolicy{MaxAttempts: 2, Backoff: "linear"}).Validate(), Equals, ErrBadConfigRetry)
+
+	// Exec-only tasks get the same checks
+	task := &Task{Id: "test-retry-validate", Cmd: &Cmd{Path: "echo"}, ExecOnly: true, Retry: &RetryPolicy{}}
+	c.Assert(task.Validate(), Equals, ErrBadConfigRetry)
+	task.Retry = nil
+	task.Service = &ServicePolicy{Restart: "sometimes"}
+	c.Assert(task.Validate(), Equals, ErrBadConfigService)
+	task.Service = &ServicePolicy{}
+	task.Matrix = &Matrix{Values: []string{"a"}}
+	c.Assert(task.Validate(), Equals, ErrBadConfigMatrix)
+	task.Service, task.Matrix = nil, nil
+	task.Cmd.Path = "no-such-command"
+	c.Assert(task.Validate(), Equals, ErrBadConfigCmdNotFound)
+}
+
+func (suite *RetryTests) TestRetryUntilFinalAttempt(c *C) {
+	delay := registry.Timeout(10 * time.Millisecond)
+	t := Task{
+		Id: "test-retry",
+		Cmd: &Cmd{
+			Path: "bash",
+			Args: []string{"-c", "exit 3"},
+		},
+		ExecOnly: true,
+		Retry:    &RetryPolicy{MaxAttempts: 3, Delay: &delay},
+	}
+
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Not(Equals), nil)
+	c.Assert(runtime.Stats.Attempts, Equals, 3)
+}
+
+func (suite *RetryTests) TestRetrySucceeds(c *C) {
+	dir, err := ioutil.TempDir("", "retry-test")
+	c.Assert(err, Equals, nil)
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	delay := registry.Timeout(10 * time.Millisecond)
+	t := Task{
+		Id: "test-retry-succeeds",
+		Cmd: &Cmd{
+			Path: "bash",
+			// Fails the first time
+			Args: []string{"-c", "if [ -f " + marker + " ]; then exit 0; fi; touch " + marker + "; exit 1"},
+		},
+		ExecOnly: true,
+		Retry:    &RetryPolicy{MaxAttempts: 3, Delay: &delay},
+	}
+
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, nil)
+	c.Assert(runtime.Stats.Attempts, Equals, 2)
+}
@@ -0,0 +1,259 @@
+package task
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// Env values of the form secret:///path/to/node name an encrypted node in the registry.
+	PrefixSecret = "secret://"
+
+	secret_mask = "********"
+
+	// Limit on zk:// and env:// pointers to pointers
+	max_pointer_hops = 10
+)
+
+var (
+	ErrNoRegistry       = errors.New("no-registry")
+	ErrNoDecrypter      = errors.New("no-decrypter")
+	ErrSecretUnresolved = errors.New("secret-unresolved")
+)
+
+// Decrypts the value of a secret node.
+type Decrypter func(path registry.Path, value []byte) ([]byte, error)
+
+// Returns a decrypter for values encrypted with AES-GCM by EncryptSecret.  The key must be
+// 16, 24 or 32 bytes.
+func AESDecrypter(key []byte) (Decrypter, error) {
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(path registry.Path, value []byte) ([]byte, error) {
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(value)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", ErrSecretUnresolved, path, err)
+		}
+		if len(sealed) < gcm.NonceSize() {
+			return nil, fmt.Errorf("%s: %s: too short", ErrSecretUnresolved, path)
+		}
+		nonce := sealed[:gcm.NonceSize()]
+		plain, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", ErrSecretUnresolved, path, err)
+		}
+		return plain, nil
+	}, nil
+}
+
+// Encrypts the value for storing in a secret node.  The result is base64(nonce || ciphertext).
+func EncryptSecret(key, value []byte) (string, error) {
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, value, nil)), nil
+}
+
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sets the decrypter for secret:// env values.
+func (this *Runtime) SetDecrypter(d Decrypter) {
+	this.decrypter = d
+}
+
+// Resolves the env entries of the command.  Values that are zk:// or env:// pointers are
+// resolved through the registry and secret:// values are read and decrypted.  All resolved
+// values are masked in logs and stdout / stderr.  See resolve_env_names for the entries resolved.
+func (this *Runtime) resolve_env() ([]string, error) {
+	env, _, err := this.resolve_env_names()
+	return env, err
+}
+
+func (this *Runtime) resolve_env_names() (env []string, resolved []string, err error) {
+	if this.Cmd.Env == nil {
+		return nil, nil, nil
+	}
+	env = make([]string, len(this.Cmd.Env))
+	for i, kv := range this.Cmd.Env {
+		env[i] = kv
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			continue
+		}
+		key, value := kv[:eq], kv[eq+1:]
+		v, err := this.resolve_value(key, value)
+		switch {
+		case err != nil:
+			return nil, nil, err
+		case v == value:
+			continue
+		}
+		this.add_secret(v)
+		env[i] = key + "=" + v
+		resolved = append(resolved, key)
+	}
+	return env, resolved, nil
+}
+
+func (this *Runtime) resolve_value(key, value string) (string, error) {
+	is_secret := strings.Index(value, PrefixSecret) == 0
+	if !is_secret && strings.Index(value, zk.PrefixZk) != 0 && strings.Index(value, zk.PrefixEnv) != 0 {
+		return value, nil
+	}
+	if this.zk == nil {
+		return "", fmt.Errorf("%s: %s", ErrNoRegistry, key)
+	}
+	if !is_secret {
+		return this.resolve_pointer(key, value)
+	}
+
+	if this.decrypter == nil {
+		return "", fmt.Errorf("%s: %s", ErrNoDecrypter, key)
+	}
+	path := registry.Path(value[len(PrefixSecret):])
+	n, err := this.zk.Get(path.Path())
+	switch {
+	case err == zk.ErrNotExist:
+		return "", fmt.Errorf("%s: %s", ErrSecretUnresolved, path)
+	case err != nil:
+		return "", err
+	}
+	plain, err := this.decrypter(path, n.GetValue())
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Follows the zk:// and env:// pointers.  Unlike zk.Resolve, the values are not logged and a
+// missing node is an error.
+func (this *Runtime) resolve_pointer(key, value string) (string, error) {
+	for hops := 0; ; hops++ {
+		var path string
+		switch {
+		case strings.Index(value, zk.PrefixEnv) == 0:
+			path = value[len(zk.PrefixEnv):]
+		case strings.Index(value, zk.PrefixZk) == 0:
+			path = value[len(zk.PrefixZk):]
+		default:
+			return value, nil
+		}
+		if hops == max_pointer_hops {
+			return "", fmt.Errorf("%s: %s: too many pointers", ErrSecretUnresolved, key)
+		}
+		n, err := this.zk.Get(path)
+		switch {
+		case err == zk.ErrNotExist:
+			return "", fmt.Errorf("%s: %s: %s", ErrSecretUnresolved, key, path)
+		case err != nil:
+			return "", err
+		}
+		value = n.GetValueString()
+	}
+}
+
+func (this *Runtime) add_secret(s string) {
+	if len(s) == 0 {
+		return
+	}
+	this.secrets_lock.Lock()
+	defer this.secrets_lock.Unlock()
+	for _, v := range this.secrets {
+		if v == s {
+			return
+		}
+	}
+	this.secrets = append(this.secrets, s)
+}
+
+// Replaces any resolved values in the string.
+func (this *Runtime) mask(s string) string {
+	this.secrets_lock.RLock()
+	defer this.secrets_lock.RUnlock()
+	for _, v := range this.secrets {
+		s = strings.Replace(s, v, secret_mask, -1)
+	}
+	return s
+}
+
+func (this *Runtime) mask_bytes(b []byte) []byte {
+	this.secrets_lock.RLock()
+	defer this.secrets_lock.RUnlock()
+	for _, v := range this.secrets {
+		b = bytes.Replace(b, []byte(v), []byte(secret_mask), -1)
+	}
+	return b
+}
+
+// Returns the length of the longest end of b that is the start of a secret.
+func (this *Runtime) partial_secret(b []byte) int {
+	this.secrets_lock.RLock()
+	defer this.secrets_lock.RUnlock()
+	longest := 0
+	for _, v := range this.secrets {
+		for n := len(v) - 1; n > longest; n-- {
+			if n <= len(b) && bytes.Equal(b[len(b)-n:], []byte(v[:n])) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Masks the writes.  The end of a write that could be the start of a secret is held until
+// the next write or Flush, so a value split across writes is masked too.
+type masking_writer struct {
+	runtime *Runtime
+	writer  io.Writer
+	pending []byte
+	lock    sync.Mutex
+}
+
+func (this *masking_writer) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	masked := this.runtime.mask_bytes(append(this.pending, p...))
+	keep := this.runtime.partial_secret(masked)
+	this.pending = append([]byte{}, masked[len(masked)-keep:]...)
+	if _, err := this.writer.Write(masked[:len(masked)-keep]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes what is held.  It is not a secret since the output ended.
+func (this *masking_writer) Flush() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.pending) == 0 {
+		return nil
+	}
+	_, err := this.writer.Write(this.pending)
+	this.pending = nil
+	return err
+}
@@ -0,0 +1,99 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+)
+
+func TestSecret(t *testing.T) { TestingT(t) }
+
+type SecretTests struct{}
+
+var _ = Suite(&SecretTests{})
+
+func (suite *SecretTests) TestEncryptDecrypt(c *C) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := EncryptSecret(key, []byte("s3cr3t"))
+	c.Assert(err, Equals, nil)
+
+	decrypt, err := AESDecrypter(key)
+	c.Assert(err, Equals, nil)
+	plain, err := decrypt(registry.Path("/secrets/db"), []byte(sealed))
+	c.Assert(err, Equals, nil)
+	c.Assert(string(plain), Equals, "s3cr3t")
+
+	other, err := AESDecrypter([]byte("fedcba9876543210fedcba9876543210"))
+	c.Assert(err, Equals, nil)
+	_, err = other(registry.Path("/secrets/db"), []byte(sealed))
+	c.Assert(strings.Index(err.Error(), ErrSecretUnresolved.Error()), Equals, 0)
+
+	_, err = AESDecrypter([]byte("short"))
+	c.Assert(err, Not(Equals), nil)
+}
+
+func (suite *SecretTests) TestResolveEnvLiteral(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-secret-literal",
+		Cmd:      &Cmd{Path: "env", Env: []string{"A=1", "B=x=y"}},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	env, err := runtime.resolve_env()
+	c.Assert(err, Equals, nil)
+	c.Assert(env, DeepEquals, []string{"A=1", "B=x=y"})
+	c.Assert(len(runtime.secrets), Equals, 0)
+}
+
+func (suite *SecretTests) TestResolveEnvNoRegistry(c *C) {
+	for _, v := range []string{"zk:///a/b", "env:///a/b", "secret:///a/b"} {
+		runtime, err := (&Task{
+			Id:       "test-secret-no-registry",
+			Cmd:      &Cmd{Path: "env", Env: []string{"A=" + v}},
+			ExecOnly: true,
+		}).Init(nil)
+		c.Assert(err, Equals, nil)
+
+		_, err = runtime.resolve_env()
+		c.Assert(err.Error(), Equals, ErrNoRegistry.Error()+": A")
+	}
+}
+
+func (suite *SecretTests) TestMask(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-secret-mask",
+		Cmd:      &Cmd{Path: "env"},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	runtime.started = 1 // events are read here instead of published
+
+	runtime.add_secret("hunter2")
+	runtime.add_secret("")
+	c.Assert(runtime.mask("password is hunter2!"), Equals, "password is ********!")
+
+	var buff bytes.Buffer
+	w := &masking_writer{runtime: runtime, writer: &buff}
+	n, err := w.Write([]byte("hunter2\n"))
+	c.Assert(err, Equals, nil)
+	c.Assert(n, Equals, 8)
+	c.Assert(buff.String(), Equals, "********\n")
+
+	// Split across writes
+	buff.Reset()
+	w.Write([]byte("a hun"))
+	c.Assert(buff.String(), Equals, "a ")
+	w.Write([]byte("ter2 and hunt"))
+	c.Assert(buff.String(), Equals, "a ******** and ")
+	c.Assert(w.Flush(), Equals, nil)
+	c.Assert(buff.String(), Equals, "a ******** and hunt")
+
+	go func() { runtime.Log("using", "hunter2") }()
+	event := LogEvent{}
+	c.Assert(json.Unmarshal(<-runtime.status, &event), Equals, nil)
+	c.Assert(event.Message, Equals, "using********")
+}
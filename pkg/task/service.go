@@ -0,0 +1,175 @@
+package task
+
+import (
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/zk"
+	"math"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultRestartDelay    = 1 * time.Second
+	DefaultRestartMaxDelay = 1 * time.Minute
+	DefaultRestartWindow   = 10 * time.Minute
+	DefaultStableUptime    = 10 * time.Second
+
+	// Ephemeral node under the namespace that exists while the service process is up.
+	live_node = "live"
+)
+
+// Returns true if the service should be restarted after a run that ended with err.
+// A cancelled service, or one that lost the exclusive lock, is never restarted.
+func (this *ServicePolicy) restartable(err error) bool {
+	switch {
+	case err == ErrCancelled, err == ErrExclusiveLost:
+		return false
+	case this.Restart == RestartNever:
+		return false
+	case this.Restart == RestartOnFailure:
+		return err != nil
+	}
+	return true
+}
+
+// Delay before restarting after the given number of consecutive runs that did not stay up
+// for the stable uptime.
+func (this *ServicePolicy) backoff(crashes int) time.Duration {
+	d := DefaultRestartDelay
+	if this.Delay != nil {
+		d = time.Duration(*this.Delay)
+	}
+	max := DefaultRestartMaxDelay
+	if this.MaxDelay != nil {
+		max = time.Duration(*this.MaxDelay)
+	}
+	if crashes > 1 {
+		d = time.Duration(float64(d) * math.Pow(2, float64(crashes-1)))
+	}
+	if d > max || d < 0 {
+		d = max
+	}
+	return d
+}
+
+func (this *ServicePolicy) window() time.Duration {
+	if this.Window == nil {
+		return DefaultRestartWindow
+	}
+	return time.Duration(*this.Window)
+}
+
+func (this *ServicePolicy) stable() time.Duration {
+	if this.StableUptime == nil {
+		return DefaultStableUptime
+	}
+	return time.Duration(*this.StableUptime)
+}
+
+func (this *ServicePolicy) Validate() error {
+	switch this.Restart {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return ErrBadConfigService
+	}
+	if this.MaxRestarts < 0 {
+		return ErrBadConfigService
+	}
+	return nil
+}
+
+// Runs the command and restarts it according to the service policy.  The returned channel
+// receives the error of the last run once the service is no longer restarted.
+func (this *Runtime) start_service() (chan error, error) {
+	policy := this.Service
+	started := time.Now()
+	done, err := this.exec()
+	if err != nil {
+		return nil, err
+	}
+
+	service_done := make(chan error, 1)
+	go func() {
+		restarts := []time.Time{}
+		crashes := 0
+		for {
+			err := <-done
+			uptime := time.Since(started)
+
+			if this.is_done() || !policy.restartable(err) {
+				service_done <- err
+				return
+			}
+
+			// Only restarts within the window count toward the limit
+			now := time.Now()
+			recent := []time.Time{}
+			for _, t := range restarts {
+				if now.Sub(t) < policy.window() {
+					recent = append(recent, t)
+				}
+			}
+			restarts = recent
+			if policy.MaxRestarts > 0 && len(restarts) >= policy.MaxRestarts {
+				this.Warn("Restarted", len(restarts), "times in", policy.window().String(), "Giving up.")
+				service_done <- ErrRestartLimit
+				return
+			}
+
+			if uptime < policy.stable() {
+				crashes++
+			} else {
+				crashes = 0
+			}
+			delay := policy.backoff(crashes)
+			if err != nil {
+				this.Log("Exited with", err.Error(), "after", uptime.String(), "Restarting in", delay.String())
+			} else {
+				this.Log("Exited after", uptime.String(), "Restarting in", delay.String())
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-this.stopped:
+				service_done <- err
+				return
+			}
+
+			restarts = append(restarts, time.Now())
+			this.Stats.Restarts++
+			started = time.Now()
+			if done, err = this.exec(); err != nil {
+				service_done <- err
+				return
+			}
+		}
+	}()
+	return service_done, nil
+}
+
+// Terminates the service process, if running, so the supervisor exits.
+func (this *Runtime) stop_service() {
+	if this.Service == nil {
+		return
+	}
+	this.Cancel(syscall.SIGTERM)
+}
+
+// Marks the service as up with an ephemeral node holding the pid or container id.
+func (this *Runtime) set_live(id string) {
+	if this.Service == nil || this.zk == nil || this.Namespace == nil {
+		return
+	}
+	if err := zk.CreateOrSetString(this.zk, this.Namespace.Sub(live_node), id, true); err != nil {
+		glog.Warningln("Task", this.Id, "cannot create liveness node. Err=", err)
+	}
+}
+
+func (this *Runtime) clear_live() {
+	if this.Service == nil || this.zk == nil || this.Namespace == nil {
+		return
+	}
+	if err := zk.DeleteObject(this.zk, this.Namespace.Sub(live_node)); err != nil {
+		glog.Warningln("Task", this.Id, "cannot delete liveness node. Err=", err)
+	}
+}
@@ -0,0 +1,97 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) { TestingT(t) }
+
+type ServiceTests struct{}
+
+var _ = Suite(&ServiceTests{})
+
+func (suite *ServiceTests) TestPolicy(c *C) {
+	always := &ServicePolicy{}
+	c.Assert(always.restartable(nil), Equals, true)
+	c.Assert(always.restartable(ErrExecFailed), Equals, true)
+	c.Assert(always.restartable(ErrCancelled), Equals, false)
+
+	on_failure := &ServicePolicy{Restart: RestartOnFailure}
+	c.Assert(on_failure.restartable(nil), Equals, false)
+	c.Assert(on_failure.restartable(ErrExecFailed), Equals, true)
+
+	never := &ServicePolicy{Restart: RestartNever}
+	c.Assert(never.restartable(ErrExecFailed), Equals, false)
+
+	delay := registry.Timeout(100 * time.Millisecond)
+	max := registry.Timeout(1 * time.Second)
+	backoff := &ServicePolicy{Delay: &delay, MaxDelay: &max}
+	c.Assert(backoff.backoff(0), Equals, 100*time.Millisecond)
+	c.Assert(backoff.backoff(1), Equals, 100*time.Millisecond)
+	c.Assert(backoff.backoff(3), Equals, 400*time.Millisecond)
+	c.Assert(backoff.backoff(10), Equals, 1*time.Second)
+
+	c.Assert((&ServicePolicy{Restart: "sometimes"}).Validate(), Equals, ErrBadConfigService)
+	c.Assert((&ServicePolicy{MaxRestarts: -1}).Validate(), Equals, ErrBadConfigService)
+}
+
+func (suite *ServiceTests) TestRestartLimit(c *C) {
+	delay := registry.Timeout(10 * time.Millisecond)
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-service-limit",
+		Cmd: &Cmd{Path: "bash", Args: []string{"-c", "exit 1"}},
+		Service: &ServicePolicy{
+			Restart:     RestartOnFailure,
+			MaxRestarts: 2,
+			Delay:       &delay,
+		},
+	})
+	c.Assert(err, Equals, ErrRestartLimit)
+	c.Assert(runtime.Stats.Restarts, Equals, 2)
+	c.Assert(runtime.Runs, Equals, 3)
+}
+
+func (suite *ServiceTests) TestExitWithoutRestart(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:      "test-service-success",
+		Cmd:     &Cmd{Path: "echo", Args: []string{"hello"}},
+		Service: &ServicePolicy{Restart: RestartOnFailure},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.Stats.Restarts, Equals, 0)
+}
+
+func (suite *ServiceTests) TestStop(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-service-stop",
+		Cmd:      &Cmd{Path: "sleep", Args: []string{"10"}},
+		ExecOnly: true,
+		Service:  &ServicePolicy{},
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+
+	time.Sleep(200 * time.Millisecond)
+	runtime.Stop()
+	c.Assert(<-done, Equals, ErrCancelled)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	c.Assert(runtime.Stats.Restarts, Equals, 0)
+}
+
+func (suite *ServiceTests) TestValidate(c *C) {
+	cron := CronExpression("@hourly")
+	_, err := (&Task{
+		Id:       "test-service-cron",
+		Cmd:      &Cmd{Path: "echo"},
+		LogTopic: "mqtt://localhost:1883/unit-test/service",
+		Trigger:  &Trigger{Cron: &cron},
+		Service:  &ServicePolicy{},
+	}).Init(nil)
+	c.Assert(err, Equals, ErrBadConfigService)
+}
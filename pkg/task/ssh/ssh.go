@@ -0,0 +1,192 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	_ssh "github.com/qorio/maestro/pkg/ssh"
+	"github.com/qorio/maestro/pkg/task"
+	crypto "golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNotStarted = errors.New("not-started")
+
+	signals = map[syscall.Signal]crypto.Signal{
+		syscall.SIGABRT: crypto.SIGABRT,
+		syscall.SIGALRM: crypto.SIGALRM,
+		syscall.SIGHUP:  crypto.SIGHUP,
+		syscall.SIGINT:  crypto.SIGINT,
+		syscall.SIGKILL: crypto.SIGKILL,
+		syscall.SIGQUIT: crypto.SIGQUIT,
+		syscall.SIGTERM: crypto.SIGTERM,
+		syscall.SIGUSR1: crypto.SIGUSR1,
+		syscall.SIGUSR2: crypto.SIGUSR2,
+	}
+)
+
+func init() {
+	task.RegisterExecutor(task.ExecutorSSH, NewExecutor)
+}
+
+// Runs the command on a remote host over ssh.
+type executor struct {
+	config  *task.SSHConfig
+	client  *_ssh.Client
+	session *crypto.Session
+	start   time.Time
+}
+
+func NewExecutor(cmd *task.Cmd) (task.Executor, error) {
+	if cmd.SSH == nil || cmd.SSH.Host == "" {
+		return nil, task.ErrBadConfigExecutor
+	}
+	return &executor{config: cmd.SSH}, nil
+}
+
+func (this *executor) Start(spec *task.ExecSpec) error {
+	auth, err := auth_method(this.config)
+	if err != nil {
+		return err
+	}
+	user := this.config.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	this.client, err = _ssh.NewClient(user, this.config.Host, auth)
+	if err != nil {
+		return err
+	}
+	this.start = time.Now()
+	env, resolved := split_env(spec.Env, spec.Resolved)
+	this.session, err = this.client.StartWithEnv(command_line(spec.Cmd, env), resolved, spec.Stdin, spec.Stdout, spec.Stderr)
+	if err != nil {
+		this.client.Close()
+		return err
+	}
+	glog.Infoln("Started on", this.config.Host, spec.Cmd.Path)
+	return nil
+}
+
+// The exit code is -1 if the remote command was killed by a signal or the connection was lost.
+func (this *executor) Wait() (*task.ExecResult, error) {
+	result := &task.ExecResult{ExitCode: -1}
+	if this.session == nil {
+		return result, ErrNotStarted
+	}
+	defer this.client.Close()
+	defer this.session.Close()
+
+	err := this.session.Wait()
+	result.WallTimeMs = int64(time.Since(this.start) / time.Millisecond)
+
+	switch err := err.(type) {
+	case nil:
+		result.ExitCode = 0
+		return result, nil
+	case *crypto.ExitError:
+		switch err.Signal() {
+		case "":
+			result.ExitCode = err.ExitStatus()
+		case "XCPU":
+			result.Signal = "SIG" + err.Signal()
+			return result, task.ErrLimitCpu
+		default:
+			result.Signal = "SIG" + err.Signal()
+		}
+		return result, task.ErrExecFailed
+	}
+	return result, err
+}
+
+// Many servers ignore signal requests so SIGKILL also closes the session, which hangs up on
+// the remote command.
+func (this *executor) Signal(sig syscall.Signal) error {
+	if this.session == nil {
+		return nil
+	}
+	s, has := signals[sig]
+	if !has {
+		s = crypto.SIGTERM
+	}
+	err := this.session.Signal(s)
+	if sig == syscall.SIGKILL {
+		return this.session.Close()
+	}
+	return err
+}
+
+func (this *executor) Id() string {
+	return this.config.Host
+}
+
+func auth_method(config *task.SSHConfig) (crypto.AuthMethod, error) {
+	if config.KeyFile != "" {
+		return _ssh.KeyFileAuthMethod(config.KeyFile)
+	}
+	return _ssh.AgentAuthMethod()
+}
+
+// Separates the entries resolved from the registry, which are set on the session so they are
+// not visible on the remote command line.
+func split_env(env, names []string) (plain, resolved []string) {
+	is_resolved := map[string]bool{}
+	for _, name := range names {
+		is_resolved[name] = true
+	}
+	for _, kv := range env {
+		if is_resolved[strings.SplitN(kv, "=", 2)[0]] {
+			resolved = append(resolved, kv)
+		} else {
+			plain = append(plain, kv)
+		}
+	}
+	return
+}
+
+// Builds the shell command line, e.g. cd '/tmp' && ulimit -t 10 && nice -n 5 env 'A=1' 'ls' '-l'
+// The cgroup limits and run as are not supported.
+func command_line(cmd *task.Cmd, env []string) string {
+	parts := []string{}
+	if cmd.Dir != "" {
+		parts = append(parts, "cd", quote(cmd.Dir), "&&")
+	}
+	if limits := cmd.Limits; limits != nil {
+		ulimit := []string{}
+		if limits.OpenFiles > 0 {
+			ulimit = append(ulimit, "-n", fmt.Sprintf("%d", limits.OpenFiles))
+		}
+		if limits.CpuSeconds > 0 {
+			ulimit = append(ulimit, "-t", fmt.Sprintf("%d", limits.CpuSeconds))
+		}
+		if limits.AddressSpace > 0 {
+			// In kilobytes
+			ulimit = append(ulimit, "-v", fmt.Sprintf("%d", limits.AddressSpace/1024))
+		}
+		if len(ulimit) > 0 {
+			parts = append(append(append(parts, "ulimit"), ulimit...), "&&")
+		}
+		if limits.Nice != 0 {
+			parts = append(parts, "nice", "-n", fmt.Sprintf("%d", limits.Nice))
+		}
+	}
+	if len(env) > 0 {
+		parts = append(parts, "env")
+		for _, kv := range env {
+			parts = append(parts, quote(kv))
+		}
+	}
+	parts = append(parts, quote(cmd.Path))
+	for _, arg := range cmd.Args {
+		parts = append(parts, quote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,51 @@
+package ssh
+
+import (
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func TestSsh(t *testing.T) { TestingT(t) }
+
+type SSHExecutorTests struct{}
+
+var _ = Suite(&SSHExecutorTests{})
+
+func (suite *SSHExecutorTests) TestCommandLine(c *C) {
+	c.Assert(command_line(&task.Cmd{Path: "echo", Args: []string{"hello world"}}, nil), Equals,
+		`'echo' 'hello world'`)
+
+	c.Assert(command_line(&task.Cmd{
+		Dir:  "/tmp",
+		Path: "sh",
+		Args: []string{"-c", "echo 'hi'"},
+	}, []string{"A=1"}), Equals, `cd '/tmp' && env 'A=1' 'sh' '-c' 'echo '\''hi'\'''`)
+}
+
+func (suite *SSHExecutorTests) TestNewExecutor(c *C) {
+	_, err := NewExecutor(&task.Cmd{Path: "echo", Executor: task.ExecutorSSH})
+	c.Assert(err, Equals, task.ErrBadConfigExecutor)
+
+	e, err := NewExecutor(&task.Cmd{Path: "echo", SSH: &task.SSHConfig{Host: "localhost"}})
+	c.Assert(err, Equals, nil)
+	c.Assert(e.Id(), Equals, "localhost")
+
+	_, err = e.Wait()
+	c.Assert(err, Equals, ErrNotStarted)
+}
+
+func (suite *SSHExecutorTests) TestCommandLineLimits(c *C) {
+	c.Assert(command_line(&task.Cmd{
+		Dir:    "/tmp",
+		Path:   "ls",
+		Limits: &task.ResourceLimits{OpenFiles: 64, CpuSeconds: 10, AddressSpace: 1 << 20, Nice: 5},
+	}, []string{"A=1"}), Equals, `cd '/tmp' && ulimit -n 64 -t 10 -v 1024 && nice -n 5 env 'A=1' 'ls'`)
+}
+
+func (suite *SSHExecutorTests) TestSplitEnv(c *C) {
+	plain, resolved := split_env([]string{"A=1", "TOKEN=s3cr=t", "B=2"}, []string{"TOKEN"})
+	c.Assert(plain, DeepEquals, []string{"A=1", "B=2"})
+	c.Assert(resolved, DeepEquals, []string{"TOKEN=s3cr=t"})
+	c.Assert(command_line(&task.Cmd{Path: "ls"}, plain), Equals, `env 'A=1' 'B=2' 'ls'`)
+}
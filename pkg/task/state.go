@@ -0,0 +1,226 @@
+package task
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	"sort"
+)
+
+const (
+	// Number of run records kept under <namespace>/runs if not set in the task.
+	DefaultKeepRuns = 20
+
+	state_node = "status"
+	runs_dir   = "runs"
+
+	// Attempts at the run sequence when other runtimes take it at the same time
+	max_seq_attempts = 10
+)
+
+// Allowed transitions of the runtime state.  A finished run can be followed by another,
+// e.g. on a cron schedule.
+var state_transitions = map[TaskStatus][]TaskStatus{
+	StatusPending:   {StatusWaiting, StatusRunning, StatusCancelled},
+	StatusWaiting:   {StatusRunning, StatusError, StatusCancelled},
+	StatusRunning:   {StatusSuccess, StatusError, StatusCancelled, StatusTimedOut},
+	StatusSuccess:   {StatusWaiting, StatusRunning},
+	StatusError:     {StatusWaiting, StatusRunning},
+	StatusCancelled: {StatusWaiting, StatusRunning},
+	StatusTimedOut:  {StatusWaiting, StatusRunning},
+}
+
+// Written to the status node under the task namespace on each change of state.
+type RuntimeState struct {
+	Status TaskStatus `json:"status"`
+	Run    int        `json:"run,omitempty"`
+	Since  int64      `json:"since"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Written to runs/<seq> under the task namespace when a run starts and when it exits.
+// Result is the path the result was written to, i.e. the success or error path.
+type RunRecord struct {
+	Seq      int           `json:"seq"`
+	Status   TaskStatus    `json:"status"`
+	Started  int64         `json:"started"`
+	Exited   int64         `json:"exited,omitempty"`
+	Attempts int           `json:"attempts,omitempty"`
+	ExitCode *int          `json:"exit_code,omitempty"`
+	Result   registry.Path `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (this *Runtime) State() RuntimeState {
+	this.state_lock.Lock()
+	defer this.state_lock.Unlock()
+	return this.state
+}
+
+// Moves to the given state and persists it.  Invalid transitions are logged and ignored.
+func (this *Runtime) set_state(status TaskStatus, err error) {
+	this.state_lock.Lock()
+	defer this.state_lock.Unlock()
+
+	switch {
+	case status == this.state.Status && err == nil:
+		return
+	case len(this.state.Status) > 0 && !valid_transition(this.state.Status, status):
+		glog.Warningln("Task", this.Id, "invalid state transition", this.state.Status, "->", status)
+		return
+	}
+
+	this.state = RuntimeState{
+		Status: status,
+		Since:  this.Now(),
+	}
+	if this.run != nil {
+		this.state.Run = this.run.Seq
+	}
+	if err != nil {
+		this.state.Error = err.Error()
+	}
+	if this.zk == nil || this.Namespace == nil {
+		return
+	}
+	if err := zk.CreateOrSet(this.zk, this.Namespace.Sub(state_node), this.state); err != nil {
+		glog.Warningln("Task", this.Id, "cannot persist state", status, "Err=", err)
+	}
+}
+
+func valid_transition(from, to TaskStatus) bool {
+	for _, s := range state_transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func status_for(err error) TaskStatus {
+	switch err {
+	case nil:
+		return StatusSuccess
+	case ErrCancelled, ErrStopped:
+		return StatusCancelled
+	case ErrExecTimeout:
+		return StatusTimedOut
+	}
+	return StatusError
+}
+
+// Starts a new run record and moves to running.
+func (this *Runtime) start_run() {
+	this.run = &RunRecord{
+		Seq:     this.Runs,
+		Status:  StatusRunning,
+		Started: this.Now(),
+	}
+	if seq, err := this.next_run_seq(); err == nil {
+		this.run.Seq = seq
+	} else if this.zk != nil && this.Namespace != nil {
+		glog.Warningln("Task", this.Id, "cannot get run sequence. Err=", err)
+	}
+	this.set_state(StatusRunning, nil)
+	this.write_run()
+	this.prune_runs()
+}
+
+// Completes the run record and moves to the final state of the run.  Files rendered for
+// the run are removed.
+func (this *Runtime) finish_run(result *ExecResult, err error) {
+	this.remove_files()
+	status := status_for(err)
+	if this.run != nil {
+		this.run.Status = status
+		this.run.Exited = this.Now()
+		this.run.Attempts = this.Stats.Attempts
+		if result != nil {
+			code := result.ExitCode
+			this.run.ExitCode = &code
+		}
+		if err != nil {
+			this.run.Error = err.Error()
+			if this.Task.Error != nil {
+				this.run.Result = *this.Task.Error
+			}
+		} else if this.Task.Success != nil {
+			this.run.Result = *this.Task.Success
+		}
+		this.write_run()
+	}
+	this.set_state(status, err)
+}
+
+// The counter is set only if unchanged since it was read, so runtimes sharing the namespace
+// never get the same sequence.  On a conflict, the counter is read again.
+func (this *Runtime) next_run_seq() (int, error) {
+	if this.zk == nil || this.Namespace == nil {
+		return 0, ErrNoRegistry
+	}
+	path := this.Namespace.Sub(runs_dir)
+	for attempt := 1; ; attempt++ {
+		n, err := this.zk.Get(path.Path())
+		if err == zk.ErrNotExist {
+			n, err = this.zk.Create(path.Path(), []byte("0"))
+		}
+		if err == nil {
+			var seq int
+			if seq, err = n.Increment(1); err == nil {
+				return seq, nil
+			}
+		}
+		if !is_conflict(err) || attempt == max_seq_attempts {
+			return 0, err
+		}
+	}
+}
+
+func is_conflict(err error) bool {
+	return err == gozk.ErrBadVersion || err == gozk.ErrNodeExists
+}
+
+func run_key(seq int) string {
+	return fmt.Sprintf("%010d", seq)
+}
+
+func (this *Runtime) write_run() {
+	if this.zk == nil || this.Namespace == nil {
+		return
+	}
+	path := this.Namespace.Sub(runs_dir, run_key(this.run.Seq))
+	if err := zk.CreateOrSet(this.zk, path, this.run); err != nil {
+		glog.Warningln("Task", this.Id, "cannot write run", path, "Err=", err)
+	}
+}
+
+func (this *Runtime) keep_runs() int {
+	if this.KeepRuns == 0 {
+		return DefaultKeepRuns
+	}
+	return this.KeepRuns
+}
+
+// Deletes the oldest run records in excess of the retention.
+func (this *Runtime) prune_runs() {
+	keep := this.keep_runs()
+	if this.zk == nil || this.Namespace == nil || keep < 0 {
+		return
+	}
+	n, err := this.zk.Get(this.Namespace.Sub(runs_dir).Path())
+	if err != nil {
+		return
+	}
+	runs, err := n.Children()
+	if err != nil {
+		return
+	}
+	sort.Sort(nodes_by_path(runs))
+	for i := 0; i < len(runs)-keep; i++ {
+		if err := zk.DeleteObject(this.zk, registry.Path(runs[i].GetPath())); err != nil {
+			glog.Warningln("Task", this.Id, "cannot prune run", runs[i].GetPath(), "Err=", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) { TestingT(t) }
+
+type StateTests struct{}
+
+var _ = Suite(&StateTests{})
+
+func (suite *StateTests) TestTransitions(c *C) {
+	c.Assert(valid_transition(StatusPending, StatusWaiting), Equals, true)
+	c.Assert(valid_transition(StatusWaiting, StatusRunning), Equals, true)
+	c.Assert(valid_transition(StatusRunning, StatusTimedOut), Equals, true)
+	c.Assert(valid_transition(StatusSuccess, StatusRunning), Equals, true)
+	c.Assert(valid_transition(StatusPending, StatusSuccess), Equals, false)
+	c.Assert(valid_transition(StatusWaiting, StatusSuccess), Equals, false)
+
+	c.Assert(status_for(nil), Equals, StatusSuccess)
+	c.Assert(status_for(ErrCancelled), Equals, StatusCancelled)
+	c.Assert(status_for(ErrStopped), Equals, StatusCancelled)
+	c.Assert(status_for(ErrExecTimeout), Equals, StatusTimedOut)
+	c.Assert(status_for(ErrExecFailed), Equals, StatusError)
+}
+
+func (suite *StateTests) TestInvalidTransitionIgnored(c *C) {
+	runtime, err := (&Task{
+		Id:       "test-state-invalid",
+		Cmd:      &Cmd{Path: "echo"},
+		ExecOnly: true,
+	}).Init(nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.State().Status, Equals, StatusPending)
+
+	runtime.set_state(StatusSuccess, nil)
+	c.Assert(runtime.State().Status, Equals, StatusPending)
+}
+
+func (suite *StateTests) TestRunSuccess(c *C) {
+	runtime, err := run_exec_only(c, Task{
+		Id:  "test-state-success",
+		Cmd: &Cmd{Path: "echo", Args: []string{"hello"}},
+	})
+	c.Assert(err, Equals, nil)
+	c.Assert(runtime.State().Status, Equals, StatusSuccess)
+	c.Assert(runtime.State().Run, Equals, 1)
+	c.Assert(runtime.run.Status, Equals, StatusSuccess)
+	c.Assert(*runtime.run.ExitCode, Equals, 0)
+	c.Assert(runtime.run.Exited >= runtime.run.Started, Equals, true)
+}
+
+func (suite *StateTests) TestRunTimedOut(c *C) {
+	timeout := registry.Timeout(100 * time.Millisecond)
+	runtime, err := run_exec_only(c, Task{
+		Id:          "test-state-timeout",
+		Cmd:         &Cmd{Path: "sleep", Args: []string{"10"}},
+		ExecTimeout: &timeout,
+	})
+	c.Assert(err, Equals, ErrExecTimeout)
+	c.Assert(runtime.State().Status, Equals, StatusTimedOut)
+	c.Assert(runtime.State().Error, Equals, ErrExecTimeout.Error())
+	c.Assert(runtime.run.Error, Equals, ErrExecTimeout.Error())
+}
+
+func (suite *StateTests) TestKeepRuns(c *C) {
+	c.Assert((&Runtime{}).keep_runs(), Equals, DefaultKeepRuns)
+	c.Assert((&Runtime{Task: Task{KeepRuns: 5}}).keep_runs(), Equals, 5)
+	c.Assert(run_key(42), Equals, "0000000042")
+}
+
+func (suite *StateTests) TestSeqConflict(c *C) {
+	c.Assert(is_conflict(gozk.ErrBadVersion), Equals, true)
+	c.Assert(is_conflict(gozk.ErrNodeExists), Equals, true)
+	c.Assert(is_conflict(gozk.ErrNoAuth), Equals, false)
+	c.Assert(is_conflict(nil), Equals, false)
+}
@@ -12,9 +12,9 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 )
@@ -26,9 +26,24 @@ var (
 	ErrBadConfigSuccess     = errors.New("bad-config-success")
 	ErrBadConfigError       = errors.New("bad-config-error")
 	ErrBadConfigCmdNotFound = errors.New("bad-config-cmd-not-found")
-
-	ErrStopped = errors.New("stopped")
-	ErrTimeout = errors.New("timeout")
+	ErrBadConfigTrigger     = errors.New("bad-config-trigger")
+	ErrBadConfigRetry       = errors.New("bad-config-retry")
+	ErrBadConfigExclusive   = errors.New("bad-config-exclusive")
+	ErrBadConfigWorkers     = errors.New("bad-config-workers")
+	ErrBadConfigOutputs     = errors.New("bad-config-outputs")
+	ErrBadConfigService     = errors.New("bad-config-service")
+	ErrBadConfigExecutor    = errors.New("bad-config-executor")
+	ErrBadConfigLimits      = errors.New("bad-config-limits")
+	ErrBadConfigFiles       = errors.New("bad-config-files")
+	ErrBadConfigMatrix      = errors.New("bad-config-matrix")
+	ErrBadConfigHeartbeat   = errors.New("bad-config-heartbeat")
+
+	ErrStopped         = errors.New("stopped")
+	ErrTimeout         = errors.New("timeout")
+	ErrCompletedByPeer = errors.New("completed-by-peer")
+	ErrExclusiveLost   = errors.New("exclusive-lost")
+	ErrCancelled       = errors.New("cancelled")
+	ErrRestartLimit    = errors.New("restart-limit")
 
 	stop_announce = Announce{Key: "stop"}
 )
@@ -48,7 +63,8 @@ type Runtime struct {
 	stdin    chan []byte
 
 	options interface{}
-	done    bool
+	started int32 // Start has been called and the log topic is published
+	done    int32 // Stop has been called
 	ready   bool
 	lock    sync.Mutex
 	error   error
@@ -56,6 +72,48 @@ type Runtime struct {
 	stdoutBuff       *bytes.Buffer
 	stdinInterceptor func(string) (string, bool)
 
+	// Line framed, sequenced writers for the stdout / stderr topics.  Kept across runs
+	// so the sequence numbers keep increasing.
+	stdout_stream *pubsub.StreamWriter
+	stderr_stream *pubsub.StreamWriter
+
+	// Masks the stdout / stderr of the process when there is no topic.
+	stdout_mask *masking_writer
+	stderr_mask *masking_writer
+
+	stopped    chan bool
+	phase      Phase
+	phase_lock sync.Mutex
+
+	exclusive      *zk.Node
+	exclusive_lock sync.Mutex
+	exclusive_lost int32
+
+	executor   Executor
+	cmd_lock   sync.Mutex
+	cancelled  int32
+	cancelling chan bool // closed on cancel
+
+	decrypter    Decrypter
+	secrets      []string
+	secrets_lock sync.RWMutex
+
+	state      RuntimeState
+	run        *RunRecord
+	state_lock sync.Mutex
+
+	// Env and funcs applied to the task.  Used again to render the files.
+	context  map[string]interface{}
+	funcs    map[string]interface{}
+	rendered []string
+
+	// Command before the substitutions and the message for a task triggered by pubsub.
+	unapplied *Cmd
+	payload   []byte
+
+	progress      *Progress
+	progress_lock sync.Mutex
+
 	Status string
 }
 
@@ -75,6 +133,9 @@ func (this *Task) Copy() (*Task, error) {
 	return copy, nil
 }
 
+// Validates the task.  An exec-only task needs only an id and a command.  Otherwise, in
+// orchestration mode, the paths and topics are checked as well.  The rest is checked in
+// both modes.
 func (this *Task) Validate() error {
 	if this.ExecOnly {
 		switch {
@@ -82,25 +143,29 @@ func (this *Task) Validate() error {
 			return ErrBadConfig
 		case this.Cmd == nil:
 			return ErrBadConfig
-		default:
-			_, err := exec.LookPath(this.Cmd.Path)
-			if err != nil {
-				return err
-			}
 		}
-		return nil
+	} else {
+		switch {
+		case this.Namespace != nil && !this.Namespace.Valid():
+			return ErrBadConfigInfo
+		case !this.LogTopic.Valid():
+			return ErrBadConfigStatus
+		case this.Success != nil && !this.Success.Valid():
+			return ErrBadConfigSuccess
+		case this.Error != nil && !this.Error.Valid():
+			return ErrBadConfigError
+		}
 	}
 
-	// If we are in Orchestration mode then a lot more needs to be set
 	switch {
-	case this.Namespace != nil && !this.Namespace.Valid():
-		return ErrBadConfigInfo
-	case !this.LogTopic.Valid():
-		return ErrBadConfigStatus
-	case this.Success != nil && !this.Success.Valid():
-		return ErrBadConfigSuccess
-	case this.Error != nil && !this.Error.Valid():
-		return ErrBadConfigError
+	case this.Cmd != nil && this.Cmd.executor() != ExecutorLocal:
+		if err := this.Cmd.validate_executor(); err != nil {
+			return err
+		}
+		// Containers have no stdin for the stdin topic or the pubsub payload
+		if this.Cmd.executor() == ExecutorDocker && (this.Stdin != nil || (this.Trigger != nil && this.Trigger.PubSub != nil)) {
+			return ErrBadConfigExecutor
+		}
 	case this.Cmd != nil:
 		_, err := exec.LookPath(this.Cmd.Path)
 		if err != nil {
@@ -108,6 +173,68 @@ func (this *Task) Validate() error {
 		}
 	}
 
+	if this.Cmd != nil && this.Cmd.Limits != nil {
+		if err := this.Cmd.Limits.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := this.validate_trigger(); err != nil {
+		return err
+	}
+
+	if this.Retry != nil {
+		if err := this.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch this.Workers {
+	case "":
+	case WorkersExclusive:
+		if this.Namespace == nil {
+			return ErrBadConfigExclusive
+		}
+	default:
+		return ErrBadConfigWorkers
+	}
+
+	if this.Outputs != nil {
+		if err := this.Outputs.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range this.Files {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if this.Heartbeat != nil {
+		if err := this.Heartbeat.Validate(this.Cmd); err != nil {
+			return err
+		}
+	}
+
+	if this.Matrix != nil {
+		if err := this.Matrix.Validate(); err != nil {
+			return err
+		}
+		if this.Trigger != nil || this.Service != nil {
+			return ErrBadConfigMatrix
+		}
+	}
+
+	if this.Service != nil {
+		if err := this.Service.Validate(); err != nil {
+			return err
+		}
+		if this.Trigger != nil && (this.Trigger.Cron != nil || this.Trigger.PubSub != nil) {
+			return ErrBadConfigService
+		}
+	}
+
 	if err := parse_template(this.LogTemplateStart, &this.templateStart); err != nil {
 		return err
 	}
@@ -123,6 +250,20 @@ func (this *Task) Validate() error {
 	return nil
 }
 
+func (this *Task) validate_trigger() error {
+	if this.Trigger == nil {
+		return nil
+	}
+	if err := this.Trigger.Validate(); err != nil {
+		return err
+	}
+	// The message is written to stdin
+	if this.Trigger.PubSub != nil && this.Stdin != nil {
+		return ErrBadConfigTrigger
+	}
+	return nil
+}
+
 func (this *Task) Init(zkc zk.ZK, options ...interface{}) (*Runtime, error) {
 	if err := this.Validate(); err != nil {
 		return nil, err
@@ -149,6 +290,9 @@ func (this *Task) Init(zkc zk.ZK, options ...interface{}) (*Runtime, error) {
 		task.stderr = make(chan []byte)
 	}
 
+	task.stopped = make(chan bool)
+	task.cancelling = make(chan bool)
+
 	// Default interceptor
 	task.stdinInterceptor = func(in string) (string, bool) {
 		return in, strings.Index(in, "#bye") != 0
@@ -158,29 +302,47 @@ func (this *Task) Init(zkc zk.ZK, options ...interface{}) (*Runtime, error) {
 
 	task.set_defaults()
 	task.start_announcer()
+	task.set_state(StatusPending, nil)
+
+	if task.Outputs != nil {
+		task.CaptureStdout()
+	}
 
 	return &task, nil
 }
 
+// Stops the runtime.  A runtime that has not been started is only marked as stopped, so a
+// later Start returns ErrStopped.
 func (this *Runtime) Stop() {
+	this.lock.Lock()
+	started := this.is_started()
+	this.lock.Unlock()
 
-	this.Log(this.build_message(this.templateStop)...)
+	if started {
+		this.log_phase(PhaseStop, this.templateStop)
+	}
 
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	if this.done {
+	if this.is_done() {
 		return
 	}
 
-	if this.stdout != nil {
+	// The streams are read only once started
+	if this.ready && this.stdout != nil {
 		this.stdout <- nil
 	}
-	if this.stderr != nil {
+	if this.ready && this.stderr != nil {
 		this.stderr <- nil
 	}
-	this.status <- nil
-	this.done = true
+	if started {
+		this.stop_service()
+		this.release_exclusive(false)
+		this.status <- nil
+	}
+	close(this.stopped)
+	atomic.StoreInt32(&this.done, 1)
 }
 
 func (this *Runtime) Announce() chan<- Announce {
@@ -226,14 +388,20 @@ func (this *Runtime) GetCapturedStdout() []byte {
 }
 
 func (this *Runtime) Stdout() io.Writer {
-	var stdout io.Writer = os.Stdout
+	if this.stdout_mask == nil {
+		this.stdout_mask = &masking_writer{runtime: this, writer: os.Stdout}
+	}
+	var stdout io.Writer = this.stdout_mask
 	if this.Task.Stdout != nil {
-		if c, err := this.Task.Stdout.Broker().PubSub(this.Id, this.options); err == nil {
-			stdout = pubsub.GetWriter(*this.Task.Stdout, c)
-		} else {
-			glog.Fatalln("Error getting stdout.", "Topic=", *this.Task.Stdout, "Err=", err)
-			return nil
+		if this.stdout_stream == nil {
+			c, err := this.Task.Stdout.Broker().PubSub(this.Id, this.options)
+			if err != nil {
+				glog.Fatalln("Error getting stdout.", "Topic=", *this.Task.Stdout, "Err=", err)
+				return nil
+			}
+			this.stdout_stream = this.new_stream(*this.Task.Stdout, c, "stdout")
 		}
+		stdout = this.stdout_stream
 	}
 	if this.stdoutBuff != nil {
 		stdout = io.MultiWriter(stdout, this.stdoutBuff)
@@ -243,55 +411,110 @@ func (this *Runtime) Stdout() io.Writer {
 
 func (this *Runtime) Stderr() io.Writer {
 	if this.Task.Stderr == nil {
-		return os.Stderr
+		if this.stderr_mask == nil {
+			this.stderr_mask = &masking_writer{runtime: this, writer: os.Stderr}
+		}
+		return this.stderr_mask
 	}
-	if c, err := this.Task.Stderr.Broker().PubSub(this.Id, this.options); err == nil {
-		return pubsub.GetWriter(*this.Task.Stderr, c)
-	} else {
-		glog.Fatalln("Error getting stderr.", "Topic=", *this.Task.Stderr, "Err=", err)
-		return nil
+	if this.stderr_stream == nil {
+		c, err := this.Task.Stderr.Broker().PubSub(this.Id, this.options)
+		if err != nil {
+			glog.Fatalln("Error getting stderr.", "Topic=", *this.Task.Stderr, "Err=", err)
+			return nil
+		}
+		this.stderr_stream = this.new_stream(*this.Task.Stderr, c, "stderr")
 	}
+	return this.stderr_stream
 }
 
-func (this *Runtime) Log(m ...interface{}) {
-	switch {
-	case len(m) == 0:
-		return
-	case this.done:
-		return
-	}
+func (this *Runtime) new_stream(topic pubsub.Topic, pub pubsub.Publisher, name string) *pubsub.StreamWriter {
+	stream := pubsub.NewStreamWriter(topic, pub, name)
+	stream.Filter = this.mask_bytes
+	return stream
+}
 
-	source := ""
-	_, file, line, ok := runtime.Caller(1)
-	if ok {
-		source = fmt.Sprintf("%s:%d", file, line)
+// Publishes any output still buffered in the stream writers.
+func (this *Runtime) flush_streams() {
+	for _, stream := range []*pubsub.StreamWriter{this.stdout_stream, this.stderr_stream} {
+		if stream == nil {
+			continue
+		}
+		if err := stream.Flush(); err != nil {
+			glog.Warningln("Cannot flush", stream.Stream, "Err=", err)
+		}
+	}
+	for _, mask := range []*masking_writer{this.stdout_mask, this.stderr_mask} {
+		if mask != nil {
+			mask.Flush()
+		}
 	}
+}
 
-	msg := fmt.Sprint(m...)
-	this.status <- []byte(msg)
-	glog.Infoln(source, m)
+// Publishes a LogEvent to the log topic.
+func (this *Runtime) Log(m ...interface{}) {
+	this.publish_event(LevelInfo, "", 2, m...)
 }
 
 func (this *Runtime) Running() bool {
-	return !this.done
+	return !this.is_done()
+}
+
+func (this *Runtime) is_started() bool {
+	return atomic.LoadInt32(&this.started) == 1
+}
+
+func (this *Runtime) is_done() bool {
+	return atomic.LoadInt32(&this.done) == 1
 }
 
 func (this *Runtime) ApplyEnvAndFuncs(env map[string]interface{}, funcs map[string]interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.Task.Outputs != nil {
+		outputs, err := this.Task.Outputs.apply_context(env)
+		if err != nil {
+			return err
+		}
+		this.Task.Outputs = outputs
+	}
+
+	if err := this.apply_files(env); err != nil {
+		return err
+	}
+	this.context = env
+	this.funcs = funcs
+
 	if this.Task.Cmd == nil {
 		return nil
 	}
 
-	this.lock.Lock()
-	defer this.lock.Unlock()
-
 	applied, err := this.Task.Cmd.ApplySubstitutions(env, funcs)
 	if err != nil {
 		return err
 	}
+	if this.Trigger != nil && this.Trigger.PubSub != nil {
+		this.unapplied = this.Task.Cmd
+	}
 	this.Task.Cmd = applied
 	return nil
 }
 
+// Parses the outputs from the captured stdout and writes them to the registry.  Secrets
+// in the stdout are masked first.
+func (this *Runtime) extract_outputs(result *ExecResult) error {
+	if this.Outputs == nil {
+		return nil
+	}
+	values, err := this.Outputs.extract(this.mask_bytes(this.GetCapturedStdout()))
+	if err != nil {
+		this.Warn("Outputs:", err.Error())
+		return err
+	}
+	result.Outputs = values
+	return this.write_outputs(values)
+}
+
 func (this *Runtime) set_defaults() {
 	if len(this.LogTopic) > 0 {
 		if this.Task.Stdout == nil {
@@ -302,6 +525,10 @@ func (this *Runtime) set_defaults() {
 			t := this.LogTopic.Sub("stderr")
 			this.Task.Stderr = &t
 		}
+		if this.Task.Control == nil {
+			t := this.LogTopic.Sub("control")
+			this.Task.Control = &t
+		}
 	}
 }
 
@@ -317,9 +544,9 @@ func parse_template(t *string, tt **template.Template) error {
 	return nil
 }
 
-func (this *Runtime) build_message(t *template.Template) []interface{} {
+func (this *Runtime) build_message(t *template.Template) string {
 	if t == nil {
-		return []interface{}{}
+		return ""
 	}
 	var buff bytes.Buffer
 	err := t.Execute(&buff, map[string]interface{}{
@@ -330,14 +557,24 @@ func (this *Runtime) build_message(t *template.Template) []interface{} {
 		"status": this.Status,
 	})
 	if err != nil {
-		return []interface{}{}
+		return ""
 	}
-	return []interface{}{buff.String()}
+	return buff.String()
 }
 
 func (this *Runtime) Start() (chan error, error) {
+	this.lock.Lock()
+	if this.is_done() {
+		this.lock.Unlock()
+		return nil, ErrStopped
+	}
+	atomic.StoreInt32(&this.started, 1)
+	this.lock.Unlock()
+
 	this.TimestampStart = this.Now()
-	this.Status = fmt.Sprint("Starting ", this.Task.Cmd.Path)
+	if this.Task.Cmd != nil {
+		this.Status = fmt.Sprint("Starting ", this.Task.Cmd.Path)
+	}
 
 	go func() {
 		for {
@@ -353,21 +590,63 @@ func (this *Runtime) Start() (chan error, error) {
 		}
 	}()
 
-	this.Log(this.build_message(this.templateStart)...)
+	this.log_phase(PhaseStart, this.templateStart)
 
 	if _, _, err := this.start_streams(); err != nil {
 		return nil, err
 	}
 
-	if err := this.block_on_triggers(); err == zk.ErrTimeout {
+	this.start_control()
+
+	// Only one runtime in the cluster runs an exclusive task.  For cron and pubsub tasks, the lock
+	// is held until the runtime is stopped.
+	if this.Task.Cmd != nil && this.Workers == WorkersExclusive {
+		if this.zk == nil {
+			return nil, ErrBadConfigExclusive
+		}
+		if err := this.wait_exclusive(); err != nil {
+			return nil, err
+		}
+	}
+
+	if this.Task.Cmd != nil && this.Trigger != nil && this.Trigger.Cron != nil {
+		return this.start_cron()
+	}
+
+	// The task did not run so it is not marked completed for the peers
+	switch err := this.block_on_triggers(); {
+	case err == zk.ErrTimeout:
+		this.release_exclusive(false)
 		return nil, ErrTimeout
+	case err != nil:
+		this.release_exclusive(false)
+		return nil, err
+	}
+
+	if this.Task.Cmd != nil && this.Trigger != nil && this.Trigger.PubSub != nil {
+		return this.start_pubsub()
 	}
 
 	// Run the actual task
 	if this.Task.Cmd != nil {
-		return this.exec()
+		var done chan error
+		var err error
+		if this.Service != nil {
+			done, err = this.start_service()
+		} else {
+			done, err = this.exec()
+		}
+		switch {
+		case err != nil:
+			this.release_exclusive(false)
+			return nil, err
+		case this.has_exclusive():
+			return this.complete_exclusive(done), nil
+		}
+		return done, nil
 	}
-	return nil, nil
+	// Without a command, the task succeeds once triggered so the tasks after it can run
+	return nil, this.Success(this.Stats)
 }
 
 func (this *Runtime) Now() int64 {
@@ -415,7 +694,7 @@ func (this *Runtime) start_announcer() {
 					}
 
 					if err != nil {
-						this.Log("Cannot annouce to", path.Path(), "Err=", err.Error())
+						this.Warn("Cannot annouce to", path.Path(), "Err=", err.Error())
 					} else {
 						this.Log("ANNOUNCE", path.Path())
 					}
@@ -426,30 +705,171 @@ func (this *Runtime) start_announcer() {
 }
 
 func (this *Runtime) block_on_triggers() error {
-	if this.Cmd == nil {
-		return nil
-	}
-
 	if this.Trigger == nil {
 		return nil
 	}
 
-	// TODO - take into account ordering of cron vs registry.
-
+	// Cron triggers are handled by the scheduler.  See start_cron.
 	if this.Trigger.Registry != nil {
-		trigger := zk.NewConditions(*this.Trigger.Registry, this.zk)
-		// So now just block until the condition is true
-		this.Log("Waiting for trigger.")
-		return trigger.Wait()
+		return this.wait_registry()
 	}
 
 	return nil
 }
 
+// Blocks until the registry conditions are met.  The conditions are instantiated on each call
+// so that this can be called repeatedly (e.g. on each cron fire).  The wait ends with ErrCancelled
+// or ErrStopped if the runtime is cancelled or stopped in the meantime.
+func (this *Runtime) wait_registry() error {
+	trigger := zk.NewConditions(*this.Trigger.Registry, this.zk)
+	this.set_phase(PhaseTriggerWait)
+	this.set_state(StatusWaiting, nil)
+	this.Log("Waiting for trigger.")
+
+	waited := make(chan bool)
+	defer close(waited)
+	go func() {
+		select {
+		case <-this.cancelling:
+		case <-this.stopped:
+		case <-waited:
+			return
+		}
+		trigger.Stop()
+	}()
+
+	err := trigger.Wait()
+	if err == zk.ErrStopped {
+		err = ErrStopped
+		if this.is_cancelled() {
+			this.Stats.Cancelled = this.Now()
+			err = ErrCancelled
+		}
+	}
+	if err != nil {
+		this.set_state(status_for(err), err)
+		return err
+	}
+	this.Stats.Triggered = this.Now()
+	return nil
+}
+
 func (this *Runtime) exec() (chan error, error) {
-	cmd := exec.Command(this.Cmd.Path, this.Cmd.Args...)
-	cmd.Dir = this.Cmd.Dir
-	cmd.Env = this.Cmd.Env
+	this.Runs++
+	this.Stats.Attempts = 0
+	this.set_phase(PhaseExec)
+	this.start_run()
+
+	if this.is_cancelled() {
+		this.Stats.Cancelled = this.Now()
+		this.Error(ErrCancelled.Error())
+		this.finish_run(nil, ErrCancelled)
+		return nil, ErrCancelled
+	}
+
+	if this.is_exclusive_lost() {
+		this.Error(ErrExclusiveLost.Error())
+		this.finish_run(nil, ErrExclusiveLost)
+		return nil, ErrExclusiveLost
+	}
+
+	if err := this.render_files(); err != nil {
+		this.Error(err.Error())
+		this.finish_run(nil, err)
+		return nil, err
+	}
+
+	cmd, err := this.prepare_cmd()
+	if err != nil {
+		this.finish_run(nil, err)
+		return nil, err
+	}
+
+	process_done := make(chan error)
+	go func() {
+		for attempt := 1; ; attempt++ {
+			if attempt > 1 {
+				if cmd, err = this.prepare_cmd(); err != nil {
+					this.Error(err.Error())
+					this.finish_run(nil, err)
+					process_done <- err
+					return
+				}
+			}
+
+			started := this.Now()
+			result, err := this.run_cmd(cmd)
+			switch {
+			case this.is_cancelled():
+				err = ErrCancelled
+			case this.is_exclusive_lost():
+				err = ErrExclusiveLost
+			}
+			this.record_attempt(attempt, started, result, err)
+			this.Stats.Result = result
+
+			if err == nil {
+				result.Output = this.mask(string(this.GetCapturedStdout()))
+				if err = this.extract_outputs(result); err == nil {
+					this.Success(result)
+					this.finish_run(result, nil)
+					process_done <- nil
+					return
+				}
+			}
+
+			if this.Retry.retryable(attempt, result.ExitCode, err) && !this.is_done() && err != ErrExclusiveLost {
+				delay := this.Retry.delay(attempt)
+				this.Log("Attempt", attempt, "failed:", err.Error(), "Retrying in", delay.String())
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+					if !this.is_cancelled() {
+						continue
+					}
+					err = ErrCancelled
+				case <-this.cancelling:
+					timer.Stop()
+					err = ErrCancelled
+				case <-this.stopped:
+					// Ends with the error of the last attempt
+					timer.Stop()
+				}
+			}
+
+			switch err {
+			case ErrExecTimeout:
+				this.Stats.TimedOut = this.Now()
+			case ErrCancelled:
+				this.Stats.Cancelled = this.Now()
+			}
+			result.Error = err.Error()
+			this.Error(result)
+			this.finish_run(result, err)
+			process_done <- err
+			return
+		}
+	}()
+
+	return process_done, nil
+}
+
+// Builds the command with its stdin / stdout / stderr hooked up.
+func (this *Runtime) prepare_cmd() (*ExecSpec, error) {
+	if this.stdoutBuff != nil {
+		this.stdoutBuff.Reset()
+	}
+
+	env, resolved, err := this.resolve_env_names()
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &ExecSpec{
+		Cmd:      this.Cmd,
+		Env:      env,
+		Resolved: resolved,
+	}
 
 	if this.Task.Stdin != nil {
 		sub, err := this.Task.Stdin.Broker().PubSub(this.Id, this.options)
@@ -460,10 +880,8 @@ func (this *Runtime) exec() (chan error, error) {
 		if err != nil {
 			return nil, err
 		}
-		wr, err := cmd.StdinPipe()
-		if err != nil {
-			return nil, err
-		}
+		rd, wr := io.Pipe()
+		spec.Stdin = rd
 
 		go func() {
 			// We need to do some special processing of input so that we can
@@ -480,45 +898,82 @@ func (this *Runtime) exec() (chan error, error) {
 				}
 			}
 		}()
+	} else if this.payload != nil {
+		spec.Stdin = bytes.NewReader(this.payload)
 	}
-	cmd.Stdout = this.Stdout()
-	cmd.Stderr = this.Stderr()
+	spec.Stdout = this.Stdout()
+	spec.Stderr = this.Stderr()
 
-	process_done := make(chan error)
-	go func() {
-		cmd.Start()
-		this.Status = "Started."
+	if this.ExecTimeout != nil || this.cancellable() || this.Service != nil || this.Workers == WorkersExclusive {
+		spec.ProcessGroup = true
+	}
+	return spec, nil
+}
 
-		// Wait for cmd to complete even if we have no more stdout/stderr
-		if err := cmd.Wait(); err != nil {
-			this.Status = err.Error()
-			this.Error(err.Error())
-			process_done <- err
-			return
-		}
+// Runs the command to completion.  The error is nil if the process exited successfully.
+func (this *Runtime) run_cmd(spec *ExecSpec) (*ExecResult, error) {
+	executor, err := new_executor(spec.Cmd)
+	if err != nil {
+		this.Status = err.Error()
+		return &ExecResult{ExitCode: -1}, err
+	}
 
-		ps := cmd.ProcessState
-		if ps == nil {
-			this.Error(ErrCommandUnknown.Error())
-			process_done <- ErrCommandUnknown
-			return
-		}
+	hb, err := this.prepare_heartbeat(spec)
+	if err != nil {
+		this.Status = err.Error()
+		return &ExecResult{ExitCode: -1}, err
+	}
+	if hb != nil {
+		defer hb.close()
+	}
 
-		this.Status = fmt.Sprint("Process pid=", ps.Pid(), "Exited=", ps.Exited(), "Success=", ps.Success())
-		glog.Infoln(this.Status)
+	start := time.Now()
+	this.cmd_lock.Lock()
+	err = executor.Start(spec)
+	if err == nil {
+		this.executor = executor
+	}
+	this.cmd_lock.Unlock()
+	if err != nil {
+		this.Status = err.Error()
+		return &ExecResult{ExitCode: -1, WallTimeMs: int64(time.Since(start) / time.Millisecond)}, err
+	}
+	this.Status = "Started."
+	this.set_live(executor.Id())
+	if hb != nil {
+		hb.start(executor.Id())
+	}
 
-		if !ps.Success() {
-			this.Error(ErrExecFailed.Error())
-			process_done <- ErrExecFailed
-			return
-		} else {
-			this.Success(this.GetCapturedStdout())
-			process_done <- nil
-			return
-		}
+	defer func() {
+		this.clear_live()
+		this.cmd_lock.Lock()
+		this.executor = nil
+		this.cmd_lock.Unlock()
 	}()
 
-	return process_done, nil
+	exited := this.watch_exec_timeout(executor)
+
+	// Wait for cmd to complete even if we have no more stdout/stderr
+	result, err := executor.Wait()
+	if result.WallTimeMs == 0 {
+		result.WallTimeMs = int64(time.Since(start) / time.Millisecond)
+	}
+	this.flush_streams()
+
+	if timed_out := exited(); timed_out {
+		this.Status = ErrExecTimeout.Error()
+		return result, ErrExecTimeout
+	}
+
+	if err != nil {
+		this.Status = err.Error()
+		return result, err
+	}
+
+	this.Status = fmt.Sprint("Process ", spec.Cmd.executor(), " id=", executor.Id(), " ExitCode=", result.ExitCode,
+		" WallTimeMs=", result.WallTimeMs, " MaxRSSKb=", result.MaxRSSKb)
+	glog.Infoln(this.Status)
+	return result, nil
 }
 
 func (this *Runtime) start_streams() (stdout, stderr chan<- []byte, err error) {
@@ -536,7 +991,7 @@ func (this *Runtime) start_streams() (stdout, stderr chan<- []byte, err error) {
 		return this.stdout, this.stderr, nil
 	}
 
-	if this.done {
+	if this.is_done() {
 		return nil, nil, ErrStopped
 	}
 	if this.stdout != nil {
@@ -579,13 +1034,13 @@ func (this *Runtime) start_streams() (stdout, stderr chan<- []byte, err error) {
 }
 
 func (this *Runtime) Success(output interface{}) error {
-	defer this.Log(this.build_message(this.templateSuccess)...)
+	defer this.log_phase(PhaseSuccess, this.templateSuccess)
 
 	if this.zk == nil {
 		glog.Infoln("Not connected to zk.  Output not recorded")
 		return nil
 	}
-	if this.done {
+	if this.is_done() {
 		return ErrStopped
 	}
 
@@ -628,13 +1083,13 @@ func (this *Runtime) Success(output interface{}) error {
 }
 
 func (this *Runtime) Error(error interface{}) error {
-	defer this.Log(this.build_message(this.templateError)...)
+	defer this.log_phase(PhaseError, this.templateError)
 
 	if this.zk == nil {
 		glog.Infoln("Not connected to zk.  Output not recorded")
 		return nil
 	}
-	if this.done {
+	if this.is_done() {
 		return ErrStopped
 	}
 
@@ -0,0 +1,71 @@
+package task
+
+import (
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultKillGracePeriod = 10 * time.Second
+)
+
+// Kills the command if it runs longer than the task's exec timeout.  It is first sent SIGTERM
+// and then SIGKILL if still running after the grace period.  Returns a function to be called
+// once the command has exited;  it returns true if it was killed because of the timeout.
+func (this *Runtime) watch_exec_timeout(executor Executor) func() bool {
+	if this.ExecTimeout == nil {
+		return func() bool { return false }
+	}
+
+	timeout := time.Duration(*this.ExecTimeout)
+	grace := DefaultKillGracePeriod
+	if this.KillGracePeriod != nil {
+		grace = time.Duration(*this.KillGracePeriod)
+	}
+
+	exited := make(chan bool)
+	timed_out := int32(0)
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-time.After(timeout):
+		}
+		atomic.StoreInt32(&timed_out, 1)
+		this.Log("Timeout after", timeout.String(), "Sending SIGTERM to", executor.Id())
+		executor.Signal(syscall.SIGTERM)
+
+		select {
+		case <-exited:
+			return
+		case <-time.After(grace):
+		}
+		this.Log("Still running after", grace.String(), "Sending SIGKILL to", executor.Id())
+		executor.Signal(syscall.SIGKILL)
+	}()
+
+	return func() bool {
+		close(exited)
+		return atomic.LoadInt32(&timed_out) == 1
+	}
+}
+
+// Run the child in its own process group so that the whole tree can be signaled.
+func set_process_group(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func signal_process_group(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
@@ -0,0 +1,81 @@
+package task
+
+import (
+	"github.com/qorio/maestro/pkg/registry"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) { TestingT(t) }
+
+type TimeoutTests struct{}
+
+var _ = Suite(&TimeoutTests{})
+
+func (suite *TimeoutTests) TestExecTimeout(c *C) {
+	timeout := registry.Timeout(200 * time.Millisecond)
+	t := Task{
+		Id: "test-timeout",
+		Cmd: &Cmd{
+			Path: "sleep",
+			Args: []string{"10"},
+		},
+		ExecOnly:    true,
+		ExecTimeout: &timeout,
+	}
+
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, ErrExecTimeout)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+	c.Assert(runtime.Stats.TimedOut > 0, Equals, true)
+}
+
+func (suite *TimeoutTests) TestKillAfterGracePeriod(c *C) {
+	timeout := registry.Timeout(200 * time.Millisecond)
+	grace := registry.Timeout(200 * time.Millisecond)
+	t := Task{
+		Id: "test-timeout-kill",
+		Cmd: &Cmd{
+			Path: "bash",
+			Args: []string{"-c", "trap '' TERM; sleep 10"},
+		},
+		ExecOnly:        true,
+		ExecTimeout:     &timeout,
+		KillGracePeriod: &grace,
+	}
+
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+
+	start := time.Now()
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, ErrExecTimeout)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (suite *TimeoutTests) TestNoTimeout(c *C) {
+	timeout := registry.Timeout(5 * time.Second)
+	t := Task{
+		Id: "test-no-timeout",
+		Cmd: &Cmd{
+			Path: "true",
+		},
+		ExecOnly:    true,
+		ExecTimeout: &timeout,
+	}
+
+	runtime, err := t.Init(nil)
+	c.Assert(err, Equals, nil)
+
+	done, err := runtime.Start()
+	c.Assert(err, Equals, nil)
+	c.Assert(<-done, Equals, nil)
+	c.Assert(runtime.Stats.TimedOut, Equals, int64(0))
+}
@@ -4,31 +4,72 @@ import (
 	"errors"
 	"github.com/qorio/maestro/pkg/pubsub"
 	"github.com/qorio/maestro/pkg/registry"
+	"regexp"
 	"text/template"
+	"time"
 )
 
 var (
 	ErrCommandUnknown = errors.New("command-unknown")
 	ErrExecFailed     = errors.New("exec-failed")
+	ErrBadCron        = errors.New("bad-cron")
+	ErrExecTimeout    = errors.New("exec-timeout")
+	ErrBadOutput      = errors.New("bad-output")
+	ErrMissingOutput  = errors.New("missing-output")
+	ErrLimitCpu       = errors.New("limit-cpu")
+	ErrLimitMemory    = errors.New("limit-memory")
 )
 
-// type Orchestration struct {
-// 	Id          string            `json:"id,omitempty"`
-// 	Name        string            `json:"name,omitempty"`
-// 	Label       string            `json:"label,omitempty"`
-// 	Description string            `json:"description,omitempty"`
-// 	Log         pubsub.Topic      `json:"log,omitempty"`
-// 	StartTime   *time.Time        `json:"start_time,omitempty"`
-// 	Context     registry.Path     `json:"context,omitempty"`
-// 	Tasks       map[TaskName]Task `json:"tasks,omitempty"`
-// }
+// An orchestration is a set of tasks chained together through the registry.  A task that
+// names another task in After is triggered when the Success path of that task is created.
+// Paths and topics may reference the orchestration context, e.g. {{.Domain}} and {{.Id}}.
+type Orchestration struct {
+	Id          string            `json:"id,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Label       string            `json:"label,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Log         pubsub.Topic      `json:"log,omitempty"`
+	StartTime   *time.Time        `json:"start_time,omitempty"`
+	Context     registry.Path     `json:"context,omitempty"`
+	Tasks       map[TaskName]Task `json:"tasks,omitempty"`
+}
 
 type CronExpression string
 
-// TODO -- add ordering.  Cron before Registry, or Registry activates cron
+// Ordering of the triggers when both cron and registry conditions are given.
+type TriggerOrder string
+
+const (
+	// Each time cron fires, wait for the registry conditions before running.
+	CronGatedByRegistry TriggerOrder = "cron-gated-by-registry"
+	// Wait for the registry conditions once, then run on the cron schedule.
+	RegistryArmsCron TriggerOrder = "registry-arms-cron"
+)
+
 type Trigger struct {
 	Cron     *CronExpression      `json:"cron,omitempty"`
 	Registry *registry.Conditions `json:"registry,omitempty"`
+	PubSub   *PubSubTrigger       `json:"pubsub,omitempty"`
+
+	// Default is cron-gated-by-registry
+	Order TriggerOrder `json:"order,omitempty"`
+}
+
+// Runs the task on messages published to the topic.  The message is available to the command
+// substitutions as {{.Message}}, and as {{.Payload}} if it is JSON, and is written to stdin.
+type PubSubTrigger struct {
+	Topic pubsub.Topic `json:"topic"`
+
+	// Only messages with the JSON fields equal to the values match.  Nested fields are
+	// separated by dots, e.g. build.branch
+	Match map[string]string `json:"match,omitempty"`
+	// Only messages matching the regex match.
+	Regex string `json:"regex,omitempty"`
+
+	// Run on the first matching message only.  Default is to run once per message.
+	Once bool `json:"once,omitempty"`
+
+	regex *regexp.Regexp
 }
 
 type Cmd struct {
@@ -36,6 +77,200 @@ type Cmd struct {
 	Path string   `json:"path"`
 	Args []string `json:"args"`
 	Env  []string `json:"env"`
+
+	// Where the command runs.  Default is local.
+	Executor ExecutorType  `json:"executor,omitempty"`
+	Docker   *DockerConfig `json:"docker,omitempty"`
+	SSH      *SSHConfig    `json:"ssh,omitempty"`
+
+	RunAs  *Credential     `json:"run_as,omitempty"`
+	Limits *ResourceLimits `json:"limits,omitempty"`
+}
+
+// Runs the process as another user.  The maestro process needs the privilege to do so.
+type Credential struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// Limits of the process.  Zero means no limit.
+type ResourceLimits struct {
+	OpenFiles  uint64 `json:"open_files,omitempty"`
+	CpuSeconds uint64 `json:"cpu_seconds,omitempty"`
+	// Bytes
+	AddressSpace uint64 `json:"address_space,omitempty"`
+
+	// -20 (highest priority) to 19
+	Nice int `json:"nice,omitempty"`
+
+	Cgroup *CgroupLimits `json:"cgroup,omitempty"`
+}
+
+// Runs the process in its own cgroup (v2) under the parent.  The parent must have the memory
+// and cpu controllers enabled for its children.
+type CgroupLimits struct {
+	// Default is /sys/fs/cgroup/maestro
+	Parent string `json:"parent,omitempty"`
+
+	// Bytes.  The process is killed by the kernel if it goes over.
+	MemoryMax uint64 `json:"memory_max,omitempty"`
+	// Number of cpus, e.g. 0.5
+	CpuMax float64 `json:"cpu_max,omitempty"`
+}
+
+type ExecutorType string
+
+const (
+	ExecutorLocal  ExecutorType = "local"
+	ExecutorDocker ExecutorType = "docker"
+	ExecutorSSH    ExecutorType = "ssh"
+)
+
+// Runs the command in a new container of the image.  The container's entrypoint is
+// replaced by the command path.
+type DockerConfig struct {
+	Endpoint string `json:"endpoint"`
+	Image    string `json:"image"`
+
+	// TLS files, if the endpoint requires TLS.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	Ca   string `json:"ca,omitempty"`
+
+	// Keep the container after it exits.  By default it is removed.
+	Keep bool `json:"keep,omitempty"`
+}
+
+// Runs the command on a remote host.  Uses the ssh agent if no key file is set.
+type SSHConfig struct {
+	Host    string `json:"host"`
+	User    string `json:"user"`
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+type WorkerMode string
+
+const (
+	// Only one runtime in the cluster runs the task.  The others stand by.
+	WorkersExclusive WorkerMode = "exclusive"
+)
+
+type BackoffType string
+
+const (
+	BackoffFixed       BackoffType = "fixed"
+	BackoffExponential BackoffType = "exponential"
+)
+
+type RetryPolicy struct {
+	// Total number of attempts, including the first.
+	MaxAttempts int `json:"max_attempts"`
+
+	// Fixed or exponential (default is fixed).  Delay is the fixed delay or the initial delay.
+	Backoff  BackoffType       `json:"backoff,omitempty"`
+	Delay    *registry.Timeout `json:"delay,omitempty"`
+	MaxDelay *registry.Timeout `json:"max_delay,omitempty"`
+
+	// Fraction of the delay, from 0 to 1, to randomly add or subtract.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// Exit codes that can be retried.  Default is any non-zero exit code.
+	ExitCodes []int `json:"exit_codes,omitempty"`
+}
+
+type OutputFormat string
+
+const (
+	OutputJSON     OutputFormat = "json"
+	OutputKeyValue OutputFormat = "kv"
+)
+
+// Maps a field parsed from stdout to a registry path.  For json, nested fields are
+// separated by dots, e.g. db.host
+type Output struct {
+	Field    string        `json:"field"`
+	Path     registry.Path `json:"path"`
+	Required bool          `json:"required,omitempty"`
+}
+
+// Declares the values to extract from stdout on success.  Default format is json.
+type Outputs struct {
+	Format OutputFormat `json:"format,omitempty"`
+	Values []Output     `json:"values"`
+}
+
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartNever     RestartPolicy = "never"
+)
+
+// Keeps a long running command alive.  Consecutive runs that exit before the stable uptime
+// are a crash loop and restarts back off exponentially from Delay up to MaxDelay.
+type ServicePolicy struct {
+	// Default is always
+	Restart RestartPolicy `json:"restart,omitempty"`
+
+	// Max restarts within the window (default 10m).  Zero means no limit.
+	MaxRestarts int               `json:"max_restarts,omitempty"`
+	Window      *registry.Timeout `json:"window,omitempty"`
+
+	Delay        *registry.Timeout `json:"delay,omitempty"`
+	MaxDelay     *registry.Timeout `json:"max_delay,omitempty"`
+	StableUptime *registry.Timeout `json:"stable_uptime,omitempty"`
+}
+
+// A file rendered from a template on the local host.  The template is executed with the
+// task env and the registry functions of pkg/template (e.g. members and inline).
+type File struct {
+	// e.g. zk:///templates/nginx.conf, http://..., file://...
+	Template string `json:"template"`
+	Path     string `json:"path"`
+	// Octal, e.g. 0600.  Default is 0644.
+	Mode       string `json:"mode,omitempty"`
+	Persistent bool   `json:"persistent,omitempty"`
+}
+
+// Keeps an ephemeral heartbeat node under the namespace updated while the command runs.  The
+// command reports progress by printing lines like "##progress 40 copied users", or by writing
+// "40 copied users" lines to the unix socket named in $MAESTRO_PROGRESS_SOCKET.
+type Heartbeat struct {
+	// Default is 10s
+	Interval *registry.Timeout `json:"interval,omitempty"`
+
+	// Listen on a socket for progress.  Local executor only.
+	Socket bool `json:"socket,omitempty"`
+}
+
+// Last progress reported by the command.  Announced under the namespace as progress.
+type Progress struct {
+	Percent float64 `json:"percent"`
+	Message string  `json:"message,omitempty"`
+	Time    int64   `json:"time"`
+}
+
+type MatrixPolicy string
+
+const (
+	// Stop starting items and cancel the running ones on the first failure.
+	MatrixFailFast MatrixPolicy = "fail-fast"
+	MatrixContinue MatrixPolicy = "continue"
+)
+
+// Items are the values or the names of the children of the registry path.  Each item is
+// substituted as {{.Item}} (or the given name) and its position as {{.Index}}.
+type Matrix struct {
+	Name     string         `json:"name,omitempty"`
+	Values   []string       `json:"values,omitempty"`
+	Children *registry.Path `json:"children,omitempty"`
+
+	// Max number of items running at once.  Zero means no limit.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// Default is fail-fast
+	Policy MatrixPolicy `json:"policy,omitempty"`
 }
 
 type Announce struct {
@@ -68,14 +303,52 @@ type Task struct {
 	// Conditional execution
 	Trigger *Trigger `json:"trigger,omitempty"`
 
+	// In an orchestration, the task whose success will trigger this task.
+	After *TaskName `json:"after,omitempty"`
+
+	// If exclusive, requires Namespace.
+	Workers WorkerMode `json:"workers,omitempty"`
+
 	// Topics (e.g. mqtt://localhost:1281/aws-cli/124/stdout)
 	LogTopic pubsub.Topic  `json:"log,omitempty"`
 	Stdin    *pubsub.Topic `json:"stdin,omitempty"`
 	Stdout   *pubsub.Topic `json:"stdout,omitempty"`
 	Stderr   *pubsub.Topic `json:"stderr,omitempty"`
 
+	// Control messages (e.g. cancel).  Defaults to <log>/control
+	Control *pubsub.Topic `json:"control,omitempty"`
+
+	// Maximum run time of the command.  When exceeded the process group is sent SIGTERM
+	// and then SIGKILL after the grace period (default 10s).
+	ExecTimeout     *registry.Timeout `json:"exec_timeout,omitempty"`
+	KillGracePeriod *registry.Timeout `json:"kill_grace_period,omitempty"`
+
+	// Optional retry of failed commands.  The error path is written after the final attempt.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// Values parsed from stdout and written to the registry.  The task fails if a required
+	// output is missing.
+	Outputs *Outputs `json:"outputs,omitempty"`
+
+	// Run the command as a supervised service.  While the process is up, an ephemeral
+	// live node is kept under the namespace.
+	Service *ServicePolicy `json:"service,omitempty"`
+
+	// Rendered before each run and removed after it, unless persistent.
+	Files []File `json:"files,omitempty"`
+
+	// Heartbeat and progress of the running command.
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+
+	// Run the task once for each item.  The aggregate result is written to the success or
+	// error path.  See InitMatrix.
+	Matrix *Matrix `json:"matrix,omitempty"`
+
 	Runs int `json:"runs,omitempty"`
 
+	// Number of run records kept under <namespace>/runs.  Default is 20.  Negative keeps all.
+	KeepRuns int `json:"keep_runs,omitempty"`
+
 	Stats TaskStats `json:"stats,omitempty"`
 
 	LogTemplateStart   *string `json:"log_template_start,omitempty"`
@@ -95,4 +368,11 @@ type TaskStats struct {
 	Triggered int64 `json:"triggered,omitempty"`
 	Success   int64 `json:"success,omitempty"`
 	Error     int64 `json:"error,omitempty"`
+	TimedOut  int64 `json:"timed_out,omitempty"`
+	Cancelled int64 `json:"cancelled,omitempty"`
+	Attempts  int   `json:"attempts,omitempty"`
+	Restarts  int   `json:"restarts,omitempty"`
+
+	// Result of the last attempt
+	Result *ExecResult `json:"result,omitempty"`
 }
@@ -0,0 +1,358 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWorkerConcurrency = 1
+
+	// Rescan the queue at this interval even without notifications, e.g. to pick up
+	// submissions whose claim was released when a worker died.
+	DefaultWorkerPollInterval = 30 * time.Second
+
+	queue_claim  = "claim"
+	queue_result = "result"
+)
+
+// Written to <queue>/<submission>/result when the task completes.
+type Outcome struct {
+	Worker   string      `json:"worker"`
+	Status   TaskStatus  `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Started  int64       `json:"started"`
+	Finished int64       `json:"finished"`
+	Result   *ExecResult `json:"result,omitempty"`
+
+	// Set instead of the result for matrix tasks
+	Matrix *MatrixResult `json:"matrix,omitempty"`
+}
+
+// A worker watches a queue path in the registry for JSON encoded tasks.  Each child of the
+// queue path is a submission.  A worker claims a submission by creating an ephemeral claim
+// node under it;  if the worker dies, the claim goes away and another worker can pick it up.
+// Submissions that have a result are skipped.  When stopped, the running tasks are cancelled
+// and their submissions released without a result so another worker can pick them up.
+type Worker struct {
+	Id           string
+	Queue        registry.Path
+	Concurrency  int
+	PollInterval time.Duration
+
+	// Decrypts secret:// env values of the tasks
+	Decrypter Decrypter
+
+	zk      zk.ZK
+	options interface{}
+
+	slots chan bool
+	freed chan bool
+	stop  chan bool
+
+	// Cancels the task of each running submission.  Nil until the task is initialized.
+	running  map[string]func()
+	stopping bool
+	tasks    sync.WaitGroup
+	lock     sync.Mutex
+}
+
+func NewWorker(zkc zk.ZK, queue registry.Path, concurrency int, options ...interface{}) *Worker {
+	if concurrency < 1 {
+		concurrency = DefaultWorkerConcurrency
+	}
+	host, _ := os.Hostname()
+	worker := &Worker{
+		Id:           fmt.Sprintf("%s:%d", host, os.Getpid()),
+		Queue:        queue,
+		Concurrency:  concurrency,
+		PollInterval: DefaultWorkerPollInterval,
+		zk:           zkc,
+		slots:        make(chan bool, concurrency),
+		freed:        make(chan bool, 1),
+		stop:         make(chan bool),
+		running:      map[string]func(){},
+	}
+	if len(options) > 0 {
+		worker.options = options[0]
+	}
+	for i := 0; i < concurrency; i++ {
+		worker.slots <- true
+	}
+	return worker
+}
+
+// Submits a task to the queue.  Returns the path of the submission.
+func Submit(zkc zk.ZK, queue registry.Path, task *Task) (registry.Path, error) {
+	name := task.Id
+	if len(name) == 0 {
+		name = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	path := queue.Sub(name)
+	value, err := json.Marshal(task)
+	if err != nil {
+		return path, err
+	}
+	_, err = zkc.Create(path.Path(), value)
+	return path, err
+}
+
+// Blocks and processes submissions until stopped.
+func (this *Worker) Run() error {
+	if !zk.PathExists(this.zk, this.Queue) {
+		if _, err := this.zk.Create(this.Queue.Path(), nil); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+
+	glog.Infoln("Worker", this.Id, "watching", this.Queue, "Concurrency=", this.Concurrency)
+	for {
+		if err := this.scan(); err != nil {
+			glog.Warningln("Worker", this.Id, "cannot scan", this.Queue, "Err=", err)
+		}
+
+		changed := make(chan bool, 1)
+		watch_stop, err := this.zk.WatchChildren(this.Queue.Path(), func(e zk.Event) {
+			changed <- true
+		})
+		if err != nil {
+			glog.Warningln("Worker", this.Id, "cannot watch", this.Queue, "Err=", err)
+		}
+
+		select {
+		case <-changed:
+		case <-this.freed:
+		case <-time.After(this.PollInterval):
+		case <-this.stop:
+			stop_watch(watch_stop)
+			this.tasks.Wait()
+			return nil
+		}
+		stop_watch(watch_stop)
+	}
+}
+
+// Cancels the running tasks and blocks until they have exited.
+func (this *Worker) Stop() {
+	this.lock.Lock()
+	if this.stopping {
+		this.lock.Unlock()
+		return
+	}
+	this.stopping = true
+	close(this.stop)
+	for path, cancel := range this.running {
+		if cancel != nil {
+			glog.Infoln("Worker", this.Id, "cancelling", path)
+			cancel()
+		}
+	}
+	this.lock.Unlock()
+
+	this.tasks.Wait()
+}
+
+func (this *Worker) is_stopping() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stopping
+}
+
+func stop_watch(stop chan<- bool) {
+	if stop == nil {
+		return
+	}
+	select {
+	case stop <- true:
+	default:
+	}
+}
+
+// Claims and starts as many submissions as there are free slots.
+func (this *Worker) scan() error {
+	top, err := this.zk.Get(this.Queue.Path())
+	if err != nil {
+		return err
+	}
+	items, err := top.Children()
+	if err != nil {
+		return err
+	}
+	sort.Sort(nodes_by_path(items))
+
+	for _, item := range items {
+		path := registry.Path(item.GetPath())
+		if this.is_running(path) || zk.PathExists(this.zk, path.Sub(queue_result)) {
+			continue
+		}
+
+		select {
+		case <-this.slots:
+		default:
+			return nil // no free slots
+		}
+
+		if !this.claim(path) {
+			this.slots <- true
+			continue
+		}
+		if !this.set_running(path, true) {
+			zk.DeleteObject(this.zk, path.Sub(queue_claim))
+			this.slots <- true
+			return nil
+		}
+		go this.run(path, item.GetValue())
+	}
+	return nil
+}
+
+// Claims the submission.  The result is checked again once claimed since a peer that
+// finished it writes the result before deleting its claim.
+func (this *Worker) claim(path registry.Path) bool {
+	_, err := this.zk.CreateEphemeral(path.Sub(queue_claim).Path(), []byte(this.Id))
+	switch err {
+	case nil:
+		if zk.PathExists(this.zk, path.Sub(queue_result)) {
+			zk.DeleteObject(this.zk, path.Sub(queue_claim))
+			return false
+		}
+		glog.Infoln("Worker", this.Id, "claimed", path)
+		return true
+	case zk.ErrNodeExists:
+	default:
+		glog.Warningln("Worker", this.Id, "cannot claim", path, "Err=", err)
+	}
+	return false
+}
+
+func (this *Worker) run(path registry.Path, value []byte) {
+	defer func() {
+		zk.DeleteObject(this.zk, path.Sub(queue_claim))
+		this.set_running(path, false)
+		this.slots <- true
+		select {
+		case this.freed <- true:
+		default:
+		}
+		this.tasks.Done()
+	}()
+
+	outcome := Outcome{
+		Worker:  this.Id,
+		Status:  StatusRunning,
+		Started: time.Now().Unix(),
+	}
+
+	err := this.execute(path, value, &outcome)
+	if err != nil && this.is_stopping() {
+		glog.Infoln("Worker", this.Id, "stopped. Released", path, "Err=", err)
+		return
+	}
+	outcome.Finished = time.Now().Unix()
+	if err != nil {
+		outcome.Status = StatusError
+		outcome.Error = err.Error()
+	} else {
+		outcome.Status = StatusSuccess
+	}
+
+	if err := zk.CreateOrSet(this.zk, path.Sub(queue_result), outcome); err != nil {
+		glog.Warningln("Worker", this.Id, "cannot write result for", path, "Err=", err)
+	}
+	glog.Infoln("Worker", this.Id, "completed", path, "Status=", outcome.Status)
+}
+
+// Runs the task to completion.  For a task on a cron schedule, only the first run counts.
+func (this *Worker) execute(path registry.Path, value []byte, outcome *Outcome) error {
+	task := new(Task)
+	if err := json.Unmarshal(value, task); err != nil {
+		return err
+	}
+	if task.Matrix != nil {
+		return this.execute_matrix(path, task, outcome)
+	}
+	runtime, err := task.Init(this.zk, this.options)
+	if err != nil {
+		return err
+	}
+	defer runtime.Stop()
+	runtime.SetDecrypter(this.Decrypter)
+	this.set_cancel(path, func() { runtime.Cancel(syscall.SIGTERM) })
+
+	done, err := runtime.Start()
+	if err != nil {
+		return err
+	}
+	if done != nil {
+		err = <-done
+	}
+	outcome.Result = runtime.Stats.Result
+	return err
+}
+
+func (this *Worker) execute_matrix(path registry.Path, task *Task, outcome *Outcome) error {
+	matrix, err := task.InitMatrix(this.zk, nil, nil, this.options)
+	if err != nil {
+		return err
+	}
+	defer matrix.Stop()
+	matrix.SetDecrypter(this.Decrypter)
+	this.set_cancel(path, matrix.Stop)
+
+	done, err := matrix.Start()
+	if err != nil {
+		return err
+	}
+	err = <-done
+	result := matrix.Result()
+	outcome.Matrix = &result
+	return err
+}
+
+func (this *Worker) is_running(path registry.Path) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, has := this.running[path.Path()]
+	return has
+}
+
+// Returns false if the worker is stopping and the submission cannot run.
+func (this *Worker) set_running(path registry.Path, running bool) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !running {
+		delete(this.running, path.Path())
+		return true
+	}
+	if this.stopping {
+		return false
+	}
+	this.running[path.Path()] = nil
+	this.tasks.Add(1)
+	return true
+}
+
+// Sets how to cancel the task of the submission.  Cancels it now if the worker is stopping.
+func (this *Worker) set_cancel(path registry.Path, cancel func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.stopping {
+		cancel()
+		return
+	}
+	this.running[path.Path()] = cancel
+}
+
+type nodes_by_path []*zk.Node
+
+func (a nodes_by_path) Len() int           { return len(a) }
+func (a nodes_by_path) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a nodes_by_path) Less(i, j int) bool { return a[i].GetPath() < a[j].GetPath() }
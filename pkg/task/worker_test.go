@@ -0,0 +1,64 @@
+package task
+
+import (
+	"fmt"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	. "gopkg.in/check.v1"
+	"testing"
+	"time"
+)
+
+func TestWorker(t *testing.T) { TestingT(t) }
+
+type WorkerTests struct{}
+
+var _ = Suite(&WorkerTests{})
+
+func (suite *WorkerTests) TestWorkerRunsSubmissions(c *C) {
+	z, err := zk.Connect(zk.ZkHosts(), 5*time.Second)
+	c.Assert(err, Equals, nil)
+	defer z.Close()
+
+	queue := registry.Path(fmt.Sprintf("/unit-test/task-test/queue/%d", time.Now().Unix()))
+
+	ok, err := Submit(z, queue, &Task{
+		Id:       "ok",
+		Cmd:      &Cmd{Path: "echo", Args: []string{"hello"}},
+		ExecOnly: true,
+	})
+	c.Assert(err, Equals, nil)
+
+	fail, err := Submit(z, queue, &Task{
+		Id:       "fail",
+		Cmd:      &Cmd{Path: "bash", Args: []string{"-c", "exit 2"}},
+		ExecOnly: true,
+	})
+	c.Assert(err, Equals, nil)
+
+	worker := NewWorker(z, queue, 2)
+	worker.PollInterval = 100 * time.Millisecond
+	go worker.Run()
+	defer worker.Stop()
+
+	wait_outcome := func(path registry.Path) Outcome {
+		outcome := Outcome{}
+		for i := 0; i < 50 && outcome.Status == ""; i++ {
+			time.Sleep(100 * time.Millisecond)
+			zk.GetObject(z, path.Sub("result"), &outcome)
+		}
+		return outcome
+	}
+
+	outcome := wait_outcome(ok)
+	c.Assert(outcome.Status, Equals, StatusSuccess)
+	c.Assert(outcome.Worker, Equals, worker.Id)
+	c.Assert(outcome.Result.ExitCode, Equals, 0)
+
+	outcome = wait_outcome(fail)
+	c.Assert(outcome.Status, Equals, StatusError)
+	c.Assert(outcome.Result.ExitCode, Equals, 2)
+
+	// Claims are released
+	c.Assert(zk.PathExists(z, ok.Sub("claim")), Equals, false)
+}
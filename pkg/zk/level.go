@@ -0,0 +1,155 @@
+package zk
+
+import (
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/registry"
+	"sync"
+	"time"
+)
+
+// Watches the state of a node rather than events on it.  The handler is evaluated against the
+// current node when the watch is applied and again on each event, when the watch is set again.
+// The group is notified each time the result changes.  The node is nil if it does not exist.
+type Level struct {
+	base
+	key registry.Key
+
+	// Members watches the children rather than the node
+	children bool
+
+	met     bool
+	applied bool
+	lock    sync.Mutex
+	stopped chan bool
+	once    sync.Once
+
+	// Stops the current zk watch
+	watch chan<- bool
+}
+
+func NewLevel(key registry.Key, zkc ZK, children bool) *Level {
+	level := &Level{key: key, children: children, stopped: make(chan bool)}
+	level.base.Init(zkc)
+	return level
+}
+
+func (this *Level) String() string {
+	return this.key.Path()
+}
+
+// Returns the result of the handler for the current state.
+func (this *Level) Met() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.met
+}
+
+func (this *Level) SetGroupChan(c chan<- watch, done <-chan bool) {
+	this.base.group, this.base.group_done = c, done
+}
+
+// The timeout is that of the conditions.
+func (this *Level) SetTimeout(t time.Duration) error {
+	return nil
+}
+
+// Blocks until stopped.
+func (this *Level) Wait() error {
+	<-this.stopped
+	return nil
+}
+
+// Stops watching.  The group is no longer notified.
+func (this *Level) Stop() {
+	this.once.Do(func() {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		close(this.stopped)
+		stop_watch(this.watch)
+		this.watch = nil
+	})
+}
+
+// Keeps the stop of the watch just set.  The watch is stopped if the level was stopped
+// in the meantime.
+func (this *Level) keep_watch(stop chan<- bool) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	select {
+	case <-this.stopped:
+		stop_watch(stop)
+		return false
+	default:
+	}
+	this.watch = stop
+	return true
+}
+
+func stop_watch(stop chan<- bool) {
+	if stop == nil {
+		return
+	}
+	select {
+	case stop <- true:
+	default:
+	}
+}
+
+func (this *Level) Apply(handler func(k registry.Key, before, after *Node) bool) error {
+	if this.zk == nil {
+		return ErrNotInitialized
+	}
+	select {
+	case <-this.stopped:
+		return nil
+	default:
+	}
+
+	// Set the watch before reading so no change is missed in between
+	on_event := func(e Event) {
+		if err := this.Apply(handler); err != nil {
+			glog.Warningln("Level:", this.key.Path(), "cannot watch. Err=", err)
+		}
+	}
+	var stop chan<- bool
+	var err error
+	if this.children {
+		stop, err = this.zk.WatchChildren(this.key.Path(), on_event)
+	} else {
+		stop, err = this.zk.Watch(this.key.Path(), on_event)
+	}
+	if err != nil {
+		return err
+	}
+	if !this.keep_watch(stop) {
+		return nil
+	}
+	after, err := this.zk.Get(this.key.Path())
+	switch {
+	case err == ErrNotExist:
+		after = nil
+	case err != nil:
+		return err
+	}
+
+	met := handler(this.key, this.before, after)
+	this.before = after
+
+	this.lock.Lock()
+	changed := !this.applied || met != this.met
+	first := !this.applied
+	this.met, this.applied = met, true
+	this.lock.Unlock()
+
+	// The first result is read by the conditions.  See Conditions.Wait
+	if changed && !first && this.group != nil {
+		this.debounced(func() {
+			select {
+			case this.group <- this:
+			case <-this.group_done:
+			case <-this.stopped:
+			}
+		})
+	}
+	return nil
+}
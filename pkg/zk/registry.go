@@ -5,6 +5,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/qorio/maestro/pkg/registry"
 	"github.com/samuel/go-zookeeper/zk"
+	"sync"
 	"time"
 )
 
@@ -13,13 +14,15 @@ var (
 	ErrNotWatching    = errors.New("not-watching")
 	ErrInvalidState   = errors.New("invalid-state")
 	ErrTimeout        = errors.New("timeout")
+	ErrStopped        = errors.New("stopped")
 )
 
 type watch interface {
 	String() string
 	SetTimeout(time.Duration) error
 	Apply(func(k registry.Key, before, after *Node) bool) error
-	SetGroupChan(chan<- watch)
+	SetGroupChan(chan<- watch, <-chan bool)
+	SetDebounce(time.Duration)
 	Wait() error
 }
 
@@ -33,23 +36,49 @@ type base struct {
 	after      *Node
 	done       chan error
 	group      chan<- watch // for sending to the group
+	group_done <-chan bool  // closed when the group no longer reads
 	error      error
 	persistent bool
+
+	// Coalesces notifications, if set
+	debounce *debounce
+}
+
+type debounce struct {
+	interval time.Duration
+	pending  *time.Timer
+	lock     sync.Mutex
 }
 
 type Conditions struct {
 	registry.Conditions
 
+	// Tree of all the conditions and the watch of each leaf.  The value in watches is
+	// true once the watch has fired.
+	tree       *registry.Condition
+	leaves     map[*registry.Condition]watch
 	watches    map[watch]bool
 	group      chan watch
 	timer      *time.Timer
 	persistent bool
+
+	// When each node with a stable_for started to hold, and the timer to evaluate the tree
+	// again when the next one has held long enough.
+	since  map[*registry.Condition]time.Time
+	stable *time.Timer
+
+	stopped chan bool
+	once    sync.Once
+	levels  []*Level // for stopping while the watches are in use by Wait
 }
 
+// Returns the watches that have not fired.
 func (this *Conditions) Pending() []watch {
 	pending := []watch{}
-	for k, _ := range this.watches {
-		pending = append(pending, k)
+	for k, met := range this.watches {
+		if !met {
+			pending = append(pending, k)
+		}
 	}
 	return pending
 }
@@ -89,102 +118,272 @@ func (this *Conditions) Init(zkc ZK) *Conditions {
 	if this.watches == nil {
 		this.watches = map[watch]bool{}
 	}
-	if this.Delete != nil {
-		w := NewDelete(*this.Delete, zkc, this.persistent)
+	this.leaves = map[*registry.Condition]watch{}
+	this.tree = this.Tree()
+	if this.tree != nil {
+		negated := map[*registry.Condition]bool{}
+		for _, leaf := range this.tree.Negated() {
+			negated[leaf] = true
+		}
+		for _, leaf := range this.tree.Leaves() {
+			w := this.new_watch(leaf, zkc, negated[leaf])
+			this.leaves[leaf] = w
+			this.watches[w] = false
+			if level, ok := w.(*Level); ok {
+				this.levels = append(this.levels, level)
+			}
+		}
+	}
+
+	this.timer = time.NewTimer(1 * time.Second)
+	this.timer.Stop()
+	if this.Timeout != nil {
+		this.timer.Reset(time.Duration(*this.Timeout))
+	}
+	this.since = map[*registry.Condition]time.Time{}
+	this.stable = time.NewTimer(1 * time.Second)
+	this.stable.Stop()
+	this.stopped = make(chan bool)
+
+	// for group synchronization
+	this.group = make(chan watch)
+	for w, _ := range this.watches {
+		w.SetGroupChan(this.group, this.stopped)
+		if this.Debounce != nil {
+			w.SetDebounce(time.Duration(*this.Debounce))
+		}
+	}
+
+	return this
+}
+
+// Negated leaves are watched for their state, like in level mode.  As events, the negation
+// would hold until the first event even while the node is in the state.
+func (this *Conditions) new_watch(leaf *registry.Condition, zkc ZK, negated bool) watch {
+	if this.Level || leaf.StableFor != nil || negated {
+		if w := new_level(leaf, zkc); w != nil {
+			return w
+		}
+	}
+	var w watch
+	switch {
+	case leaf.Delete != nil:
+		w = NewDelete(*leaf.Delete, zkc, this.persistent)
 		w.Apply(func(k registry.Key, before, after *Node) bool {
 			glog.V(100).Infoln("Delete:", k.Path(), "Before=", before, "After=", after)
 			return true
 		})
-		this.watches[w] = false
-	}
-	if this.Create != nil {
-		w := NewCreate(*this.Create, zkc, this.persistent)
+	case leaf.Create != nil:
+		w = NewCreate(*leaf.Create, zkc, this.persistent)
 		w.Apply(func(k registry.Key, before, after *Node) bool {
 			glog.V(100).Infoln("Create:", k.Path(), "Before=", before, "After=", after)
 			return true
 		})
-		this.watches[w] = false
-	}
-	if this.Change != nil {
-		w := NewChange(*this.Change, zkc, this.persistent)
+	case leaf.Change != nil:
+		predicate := leaf.Value
+		w = NewChange(*leaf.Change, zkc, this.persistent)
 		w.Apply(func(k registry.Key, before, after *Node) bool {
 			glog.V(100).Infoln("Change:", k.Path(), "Before=", before, "After=", after)
-			return true
+			return predicate == nil || ValueMet(*predicate, before, after)
 		})
-		this.watches[w] = false
-	}
-	if this.Members != nil {
-		w := NewMembers(*this.Members, zkc, this.persistent)
+	case leaf.Members != nil:
+		members := *leaf.Members
+		w = NewMembers(members, zkc, this.persistent)
 		w.Apply(func(k registry.Key, before, after *Node) bool {
 			glog.V(100).Infoln("Members:", k.Path(), "Before=", before.Stats.NumChildren, "After=", after.Stats.NumChildren)
+			return MembersMet(members, before.Stats.NumChildren, after.Stats.NumChildren)
+		})
+	}
+	return w
+}
 
-			met := false
-			switch {
-			case this.Members.Max != nil && this.Members.Min != nil:
-				if this.Members.OutsideRange {
-					met = after.Stats.NumChildren < *this.Members.Min || after.Stats.NumChildren >= *this.Members.Max
-				} else {
-					met = after.Stats.NumChildren >= *this.Members.Min && after.Stats.NumChildren < *this.Members.Max
-				}
-			case this.Members.Max != nil:
-				if this.Members.OutsideRange {
-					met = after.Stats.NumChildren >= *this.Members.Max
-				} else {
-					met = after.Stats.NumChildren < *this.Members.Max
-				}
-			case this.Members.Min != nil:
-				if this.Members.OutsideRange {
-					met = after.Stats.NumChildren < *this.Members.Min
-				} else {
-					met = after.Stats.NumChildren >= *this.Members.Min
-				}
-			case this.Members.Delta != nil:
-				met = after.Stats.NumChildren-before.Stats.NumChildren == *this.Members.Delta
-			case this.Members.Equals != nil:
-				met = after.Stats.NumChildren == *this.Members.Equals
+// Returns a level watch for the leaf, or nil if the leaf is only meaningful as an event:
+// a change without a value predicate or with the changed op, and a delta of members.
+func new_level(leaf *registry.Condition, zkc ZK) watch {
+	var w *Level
+	var handler func(k registry.Key, before, after *Node) bool
+	switch {
+	case leaf.Delete != nil:
+		w = NewLevel(*leaf.Delete, zkc, false)
+		handler = func(k registry.Key, before, after *Node) bool {
+			return after == nil
+		}
+	case leaf.Create != nil:
+		w = NewLevel(*leaf.Create, zkc, false)
+		handler = func(k registry.Key, before, after *Node) bool {
+			return after != nil
+		}
+	case leaf.Change != nil && leaf.Value != nil && leaf.Value.Op != registry.OpChanged:
+		predicate := *leaf.Value
+		w = NewLevel(*leaf.Change, zkc, false)
+		handler = func(k registry.Key, before, after *Node) bool {
+			return ValueMet(predicate, nil, after)
+		}
+	case leaf.Members != nil && leaf.Members.Delta == nil:
+		members := *leaf.Members
+		w = NewLevel(members, zkc, true)
+		handler = func(k registry.Key, before, after *Node) bool {
+			count := int32(0)
+			if after != nil && after.Stats != nil {
+				count = after.Stats.NumChildren
 			}
-			return met
-		})
-		this.watches[w] = false
+			return MembersMet(members, count, count)
+		}
+	default:
+		return nil
+	}
+	if err := w.Apply(func(k registry.Key, before, after *Node) bool {
+		met := handler(k, before, after)
+		glog.V(100).Infoln("Level:", k.Path(), "After=", after, "Met=", met)
+		return met
+	}); err != nil {
+		glog.Warningln("Level:", w, "cannot watch. Err=", err)
 	}
+	return w
+}
 
-	this.timer = time.NewTimer(1 * time.Second)
-	this.timer.Stop()
-	if this.Timeout != nil {
-		this.timer.Reset(time.Duration(*this.Timeout))
+// Evaluates the tree with the watches that have fired as true.  False if there are no
+// conditions.  A node with a stable_for is true once it has held for the duration.  If one
+// is holding but not long enough, the stable timer is set for when it will be.
+func (this *Conditions) met() bool {
+	if this.tree == nil {
+		return false
 	}
+	now := time.Now()
+	next := time.Duration(0)
+	met := this.tree.Eval(func(leaf *registry.Condition) bool {
+		return this.watches[this.leaves[leaf]]
+	}, func(c *registry.Condition, v bool) bool {
+		if !v {
+			delete(this.since, c)
+			return false
+		}
+		since, has := this.since[c]
+		if !has {
+			since = now
+			this.since[c] = now
+		}
+		wait := time.Duration(*c.StableFor) - now.Sub(since)
+		if wait <= 0 {
+			return true
+		}
+		if next == 0 || wait < next {
+			next = wait
+		}
+		return false
+	})
 
-	// for group synchronization
-	this.group = make(chan watch)
-	for w, _ := range this.watches {
-		w.SetGroupChan(this.group)
+	if !this.stable.Stop() {
+		select {
+		case <-this.stable.C:
+		default:
+		}
+	}
+	if !met && next > 0 {
+		this.stable.Reset(next)
 	}
+	return met
+}
 
-	return this
+// Returns true if the value after the change satisfies the predicate.  A node that does not
+// exist has no value.
+func ValueMet(p registry.Predicate, before, after *Node) bool {
+	var b, a []byte
+	if before != nil {
+		b = before.GetValue()
+	}
+	if after != nil {
+		a = after.GetValue()
+	}
+	return p.Met(b, a)
+}
+
+// Returns true if the change in the number of children from before to after satisfies
+// the members condition.
+func MembersMet(m registry.Members, before, after int32) bool {
+	switch {
+	case m.Max != nil && m.Min != nil:
+		if m.OutsideRange {
+			return after < *m.Min || after >= *m.Max
+		}
+		return after >= *m.Min && after < *m.Max
+	case m.Max != nil:
+		if m.OutsideRange {
+			return after >= *m.Max
+		}
+		return after < *m.Max
+	case m.Min != nil:
+		if m.OutsideRange {
+			return after < *m.Min
+		}
+		return after >= *m.Min
+	case m.Delta != nil:
+		return after-before == *m.Delta
+	case m.Equals != nil:
+		return after == *m.Equals
+	}
+	return false
 }
 
-// Simply blocks until it's either true or a timeout occurs.
+// Simply blocks until it's either true, a timeout occurs or it is stopped.
 // The error will indicate whether the condition is met or a timeout took place.
+// The whole tree is evaluated each time a watch fires.  A tree that is true before any
+// watch fires, e.g. !create(/maintenance) while the node does not exist, returns immediately.
+// Level watches hold the current state.  Unless persistent, the conditions are stopped on
+// return so the level watches end and notifications still pending are dropped.
 func (this *Conditions) Wait() error {
+	if !this.persistent {
+		defer this.Stop()
+	}
+	for w, _ := range this.watches {
+		if level, ok := w.(*Level); ok {
+			this.watches[w] = level.Met()
+		}
+	}
+	if this.met() {
+		return nil
+	}
 	for {
 		select {
 		case w := <-this.group:
-			if _, has := this.watches[w]; has {
-				delete(this.watches, w)
-			} else {
+			if _, has := this.watches[w]; !has {
 				panic(ErrInvalidState)
 			}
+			if level, ok := w.(*Level); ok {
+				this.watches[w] = level.Met()
+			} else {
+				this.watches[w] = true
+			}
+
+			if this.met() {
+				return nil
+			}
 
-			if !this.All || len(this.watches) == 0 {
+		case <-this.stable.C:
+			if this.met() {
 				return nil
 			}
 
 		case <-this.timer.C:
 			return ErrTimeout
+
+		case <-this.stopped:
+			return ErrStopped
 		}
 	}
 }
 
+// Stops waiting.  Wait returns ErrStopped.  The level watches, kept when persistent, are
+// stopped too.
+func (this *Conditions) Stop() {
+	this.once.Do(func() {
+		close(this.stopped)
+		for _, level := range this.levels {
+			level.Stop()
+		}
+	})
+}
+
 func (this *Create) Wait() error {
 	return this.base.wait()
 }
@@ -249,20 +448,20 @@ func NewMembers(m registry.Members, zkc ZK, persistent ...bool) watch {
 	return members
 }
 
-func (this *Delete) SetGroupChan(c chan<- watch) {
-	this.base.group = c
+func (this *Delete) SetGroupChan(c chan<- watch, done <-chan bool) {
+	this.base.group, this.base.group_done = c, done
 }
 
-func (this *Create) SetGroupChan(c chan<- watch) {
-	this.base.group = c
+func (this *Create) SetGroupChan(c chan<- watch, done <-chan bool) {
+	this.base.group, this.base.group_done = c, done
 }
 
-func (this *Change) SetGroupChan(c chan<- watch) {
-	this.base.group = c
+func (this *Change) SetGroupChan(c chan<- watch, done <-chan bool) {
+	this.base.group, this.base.group_done = c, done
 }
 
-func (this *Members) SetGroupChan(c chan<- watch) {
-	this.base.group = c
+func (this *Members) SetGroupChan(c chan<- watch, done <-chan bool) {
+	this.base.group, this.base.group_done = c, done
 }
 
 func (this *base) SetTimeout(t time.Duration) error {
@@ -283,10 +482,35 @@ func (this *base) SetTimeout(t time.Duration) error {
 	return nil
 }
 
+func (this *base) SetDebounce(d time.Duration) {
+	this.debounce = &debounce{interval: d}
+}
+
 func (this *base) notify(w watch) {
 	if this.group != nil {
-		this.group <- w
+		this.debounced(func() {
+			select {
+			case this.group <- w:
+			case <-this.group_done:
+			}
+		})
+	}
+}
+
+// Sends now if there is no debounce.  Otherwise sends once there has been no other
+// notification for the debounce, dropping the ones before.
+func (this *base) debounced(send func()) {
+	if this.debounce == nil || this.debounce.interval <= 0 {
+		send()
+		return
+	}
+	d := this.debounce
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pending != nil {
+		d.pending.Stop()
 	}
+	d.pending = time.AfterFunc(d.interval, send)
 }
 
 func (this *base) cancel() error {
@@ -637,3 +637,258 @@ func (suite *RegistryTests) TestConditionsMemberOutsideRange(c *C) {
 
 	c.Assert(n, Equals, int32(5))
 }
+
+func (suite *RegistryTests) TestConditionsExpr(c *C) {
+
+	db, config, flag, maintenance := test_ns("/expr/db"), test_ns("/expr/config"),
+		test_ns("/expr/flag"), test_ns("/expr/maintenance")
+	CreateOrSet(suite.zk, db, "db")
+	CreateOrSet(suite.zk, config, "v1")
+
+	expr, err := r.ParseCondition(fmt.Sprintf("members(%s) >= 1 && (change(%s) || create(%s)) && !create(%s)",
+		db, config, flag, maintenance))
+	c.Assert(err, Equals, nil)
+
+	timeout := r.Timeout(10 * time.Second)
+	cond := r.Conditions{
+		Timeout: &timeout,
+		Expr:    expr,
+	}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// Only the members condition is met
+	CreateOrSet(suite.zk, db.Member("a"), "foo")
+	select {
+	case <-received:
+		c.Fail()
+	case <-time.After(1 * time.Second):
+	}
+	c.Assert(len(conditions.Pending()), Equals, 3)
+
+	// Now the or
+	CreateOrSet(suite.zk, flag, "on")
+	err = <-received
+	c.Assert(err, Equals, nil)
+}
+
+func (suite *RegistryTests) TestConditionsExprNot(c *C) {
+
+	ready, maintenance := test_ns("/expr-not/ready"), test_ns("/expr-not/maintenance")
+
+	timeout := r.Timeout(2 * time.Second)
+	create := r.Create(ready)
+	cond := r.Conditions{
+		Timeout: &timeout,
+		Create:  &create,
+		Expr:    &r.Condition{Not: &r.Condition{Create: (*r.Create)(&maintenance)}},
+	}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// Maintenance blocks the and
+	CreateOrSet(suite.zk, maintenance, "on")
+	time.Sleep(500 * time.Millisecond)
+	CreateOrSet(suite.zk, ready, "yes")
+
+	err := <-received
+	c.Assert(err, Equals, ErrTimeout)
+}
+
+func (suite *RegistryTests) TestConditionsExprNotExisting(c *C) {
+
+	ready, maintenance := test_ns("/expr-not-existing/ready"), test_ns("/expr-not-existing/maintenance")
+	CreateOrSet(suite.zk, maintenance, "on")
+
+	expr, err := r.ParseCondition(fmt.Sprintf("create(%s) && !create(%s)", ready, maintenance))
+	c.Assert(err, Equals, nil)
+	timeout := r.Timeout(2 * time.Second)
+	conditions := NewConditions(r.Conditions{Timeout: &timeout, Expr: expr}, suite.zk)
+
+	received := make(chan error)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// Maintenance exists from the start so the negation does not hold
+	CreateOrSet(suite.zk, ready, "yes")
+	c.Assert(<-received, Equals, ErrTimeout)
+}
+
+func (suite *RegistryTests) TestConditionsChangeValue(c *C) {
+
+	p := test_ns("/change-value/app")
+	CreateOrSet(suite.zk, p, `{"status":"starting"}`)
+
+	timeout := r.Timeout(10 * time.Second)
+	change := r.Change(p)
+	cond := r.Conditions{
+		Timeout: &timeout,
+		Change:  &change,
+		Value:   &r.Predicate{Field: ".status", Op: r.OpEquals, Value: "ready"},
+	}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// A change to another value does not fire
+	CreateOrSet(suite.zk, p, `{"status":"warming"}`)
+	select {
+	case <-received:
+		c.Fail()
+	case <-time.After(1 * time.Second):
+	}
+
+	CreateOrSet(suite.zk, p, `{"status":"ready"}`)
+	err := <-received
+	c.Assert(err, Equals, nil)
+}
+
+func (suite *RegistryTests) TestConditionsLevelAlreadyTrue(c *C) {
+
+	ready, gone := test_ns("/level/ready"), test_ns("/level/gone")
+	CreateOrSet(suite.zk, ready, "yes")
+
+	timeout := r.Timeout(2 * time.Second)
+	create, delete := r.Create(ready), r.Delete(gone)
+	cond := r.Conditions{
+		Timeout: &timeout,
+		Create:  &create,
+		Delete:  &delete,
+		All:     true,
+		Level:   true,
+	}
+
+	// Both hold already, so there is no event to wait for
+	err := NewConditions(cond, suite.zk).Wait()
+	c.Assert(err, Equals, nil)
+
+	// Without level the create is never seen
+	cond.Level = false
+	err = NewConditions(cond, suite.zk).Wait()
+	c.Assert(err, Equals, ErrTimeout)
+}
+
+func (suite *RegistryTests) TestConditionsLevel(c *C) {
+
+	app, db := test_ns("/level/app"), test_ns("/level/db")
+	CreateOrSet(suite.zk, app, `{"status":"starting"}`)
+	CreateOrSet(suite.zk, db.Member("1"), "m1")
+
+	timeout := r.Timeout(10 * time.Second)
+	expr, err := r.ParseCondition(fmt.Sprintf(`change(%s).status == "ready" && members(%s) >= 2`, app, db))
+	c.Assert(err, Equals, nil)
+	cond := r.Conditions{Timeout: &timeout, Expr: expr, Level: true}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// The value is ready but one member short
+	CreateOrSet(suite.zk, app, `{"status":"ready"}`)
+	select {
+	case <-received:
+		c.Fail()
+	case <-time.After(1 * time.Second):
+	}
+
+	CreateOrSet(suite.zk, db.Member("2"), "m2")
+	err = <-received
+	c.Assert(err, Equals, nil)
+
+	// Holds on the current state with no events
+	err = NewConditions(cond, suite.zk).Wait()
+	c.Assert(err, Equals, nil)
+}
+
+func (suite *RegistryTests) TestConditionsStableFor(c *C) {
+
+	lb := test_ns("/stable-for/lb")
+
+	timeout := r.Timeout(10 * time.Second)
+	expr, err := r.ParseCondition(fmt.Sprintf("members(%s) >= 2 for 1s", lb))
+	c.Assert(err, Equals, nil)
+	cond := r.Conditions{Timeout: &timeout, Expr: expr}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// A member that flaps resets the window
+	CreateOrSet(suite.zk, lb.Member("1"), "m1")
+	CreateOrSet(suite.zk, lb.Member("2"), "m2")
+	time.Sleep(500 * time.Millisecond)
+	DeleteObject(suite.zk, lb.Member("2"))
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	CreateOrSet(suite.zk, lb.Member("2"), "m2")
+	select {
+	case <-received:
+		c.Fail()
+	case <-time.After(700 * time.Millisecond):
+	}
+
+	err = <-received
+	c.Assert(err, Equals, nil)
+	c.Assert(time.Since(start) >= time.Second, Equals, true)
+}
+
+func (suite *RegistryTests) TestConditionsDebounce(c *C) {
+
+	workers := test_ns("/debounce/workers")
+	CreateOrSet(suite.zk, workers, "")
+
+	timeout := r.Timeout(5 * time.Second)
+	debounce := r.Timeout(500 * time.Millisecond)
+	min := int32(1)
+	cond := r.Conditions{
+		Timeout:  &timeout,
+		Members:  &r.Members{Top: workers, Min: &min},
+		Debounce: &debounce,
+	}
+
+	received := make(chan error)
+
+	conditions := NewConditions(cond, suite.zk, true)
+	go func() {
+		received <- conditions.Wait()
+	}()
+
+	// Each member is a notification of the persistent watch.  The burst, within the
+	// debounce, is one notification after the last member.
+	for i := 0; i < 5; i++ {
+		CreateOrSet(suite.zk, workers.Member(fmt.Sprintf("%d", i)), "w")
+		time.Sleep(50 * time.Millisecond)
+	}
+	last := time.Now()
+	err := <-received
+	c.Assert(err, Equals, nil)
+	c.Assert(time.Since(last) >= 400*time.Millisecond, Equals, true)
+
+	// No other notification follows
+	select {
+	case <-conditions.group:
+		c.Fail()
+	case <-time.After(1 * time.Second):
+	}
+}
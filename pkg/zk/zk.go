@@ -80,6 +80,7 @@ type ZK interface {
 	Events() <-chan Event
 	Create(string, []byte) (*Node, error)
 	CreateEphemeral(string, []byte) (*Node, error)
+	CreateEphemeralSequential(string, []byte) (*Node, error)
 	Get(string) (*Node, error)
 	Watch(string, func(Event)) (chan<- bool, error)
 	WatchChildren(string, func(Event)) (chan<- bool, error)
@@ -483,6 +484,25 @@ func (this *zookeeper) CreateEphemeral(path string, value []byte) (*Node, error)
 	return this.create(path, value, true)
 }
 
+// Creates an ephemeral node with a monotonically increasing sequence number appended to path.
+// Unlike other ephemeral nodes, this is not re-created on reconnect since the sequence number
+// would change.
+func (this *zookeeper) CreateEphemeralSequential(path string, value []byte) (*Node, error) {
+	if err := this.check(); err != nil {
+		return nil, err
+	}
+	if err := this.build_parents(path); err != nil {
+		return nil, err
+	}
+	flags := int32(zk.FlagEphemeral | zk.FlagSequence)
+	p, err := this.conn.Create(path, value, flags, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		return nil, err
+	}
+	glog.Infoln("EPHEMERAL-SEQUENTIAL: created Path=", p, "Value=", string(value))
+	return this.Get(p)
+}
+
 func (this *zookeeper) Delete(path string) error {
 	if err := this.check(); err != nil {
 		return err
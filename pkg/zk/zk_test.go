@@ -218,6 +218,35 @@ func (suite *ZkTests) TestEphemeral(c *C) {
 	z2.Close()
 }
 
+func (suite *ZkTests) TestEphemeralSequential(c *C) {
+	z1, err := Connect(ZkHosts(), time.Second)
+	c.Assert(err, Equals, nil)
+
+	p := fmt.Sprintf("/unit-test/seq/%d/member-", time.Now().Unix())
+	n1, err := z1.CreateEphemeralSequential(p, []byte("1"))
+	c.Assert(err, Equals, nil)
+	n2, err := z1.CreateEphemeralSequential(p, []byte("2"))
+	c.Assert(err, Equals, nil)
+	c.Log("n1", n1.GetPath(), "n2", n2.GetPath())
+
+	c.Assert(n1.GetPath() < n2.GetPath(), Equals, true)
+	c.Assert(n1.GetValueString(), Equals, "1")
+
+	z2, err := Connect(ZkHosts(), time.Second)
+	c.Assert(err, Equals, nil)
+	_, err = z2.Get(n1.GetPath())
+	c.Assert(err, Equals, nil)
+
+	z1.Close() // both should go away
+
+	_, err = z2.Get(n1.GetPath())
+	c.Assert(err, Equals, ErrNotExist)
+	_, err = z2.Get(n2.GetPath())
+	c.Assert(err, Equals, ErrNotExist)
+
+	z2.Close()
+}
+
 func (suite *ZkTests) TestWatcher(c *C) {
 	z1, err := Connect(ZkHosts(), time.Second)
 	c.Assert(err, Equals, nil)